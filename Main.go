@@ -1,15 +1,18 @@
 package main
 
 import (
+	lib "./lib"
+
 	"github.com/Sirupsen/logrus"
 	"github.com/docker/go-plugins-helpers/volume"
 
+	"context"
+	"errors"
 	"fmt"
 	"log"
-	"os/exec"
-	"path/filepath"
-	"strings"
+	"os/signal"
 	"os"
+	"syscall"
 )
 
 const (
@@ -18,12 +21,6 @@ const (
 	logfile		  = "/var/log/docker-volume-cephfs.log"
 )
 
-var (
-	defaultPath = filepath.Join(volume.DefaultDockerRootDirectory, cephfsId)
-	monitor = ""
-	user = "admin.clinet"
-	secretfile = "/etc/ceph/admin.secretfile"
-)
 
 func main() {
 
@@ -33,76 +30,72 @@ func main() {
 	}
 
 
-	file, err := setupLogging()
+	config, args, err := LoadConfiguration(os.Args[1:])
+	if(err != nil) {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+	config.ApplyLogLevel()
+
+	if(len(args) > 0) {
+		switch args[0] {
+		case "snapshot":
+			err = snapshotCommand(config, args[1:])
+		default:
+			err = errors.New("Unknown command "+args[0])
+		}
+		if(err != nil) {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
+	file, err := setupLogging(config.Log.File)
 	if(err != nil) {
 		fmt.Println("Logging not possible.")
 	} else {
 		defer shutdownLogging(file)
 	}
-	EnvironmentConfiguration()
 
 	var setup = func() {
-		fmt.Printf("Path %s\n", defaultPath)
+		fmt.Printf("Path %s\n", config.Path)
 	}
 
 	Usage()
 	setup()
 
-	fstype := LookupFileSystemType(defaultPath)
-	if !strings.Contains(fstype, "ceph") {
-		log.Print("Warning CePH filesystem not found at ", defaultPath, " found ", fstype)
+	runner := lib.NewShellRunner()
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	err = checkRoot(ctx, runner, lib.NewMountInspector(mountInfoFile, mountCheckTimeout), config)
+	cancel()
+	if(err != nil) {
+		fmt.Println(err.Error())
+		os.Exit(1)
 	}
 
-	driver, err := newCephFSDriver(defaultPath, monitor, user, secretfile)
-	if err != nil {
-		return
+	driver, err := newCephFSDriver(runner, config)
+	if(err != nil) {
+		logrus.Error(err.Error())
+		fmt.Println(err.Error())
+		os.Exit(1)
 	}
+	go driver.RunSnapshotSchedule(snapshotInterval, nil)
+	go driver.RunHealthMonitor(healthInterval, nil)
+
+	// SIGHUP refreshes the volume index on demand
+	refresh := make(chan os.Signal, 1)
+	signal.Notify(refresh, syscall.SIGHUP)
+	go driver.RunIndexRefresh(config.IndexRefresh, refresh, nil)
+
 	h := volume.NewHandler(&driver)
 
 	fmt.Printf("Listening on %s\n", socketAddress)
 	fmt.Println(h.ServeUnix(socketAddress, 1))
 }
 
-func LookupFileSystemType(path string) string {
-	out, err := exec.Command("df", "--no-sync", "--output=fstype", path).Output()
-
-	if err != nil {
-		log.Fatal("Unable to read df output", err)
-	}
-
-	fstype := strings.Split(string(out), "\n")[1]
-	return fstype
-}
-
-func EnvironmentConfiguration() {
-	path := os.Getenv("DEFAULT_PATH")
-	monitor = os.Getenv("DEFAULT_MONITOR")
-	user = os.Getenv("CEPH_USER")
-	secretfile = os.Getenv("CEPH_SECRETFILE")
-
-	if(len(defaultPath) > 0 ) {
-		defaultPath = path
-	}
-
-	logLevel := os.Getenv("LOG_LEVEL")
-
-	switch logLevel {
-	case "3":
-		logrus.SetLevel(logrus.DebugLevel)
-		break;
-	case "2":
-		logrus.SetLevel(logrus.InfoLevel)
-		break;
-	case "1":
-		logrus.SetLevel(logrus.WarnLevel)
-		break;
-	default:
-		logrus.SetLevel(logrus.ErrorLevel)
-	}
-}
-
 // setupLogging attempts to log to a file, otherwise stderr
-func setupLogging() (*os.File, error) {
+func setupLogging(logfile string) (*os.File, error) {
 	// use date, time and filename for log output
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
 	log.SetPrefix("docker-volume-cephfs")
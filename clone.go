@@ -0,0 +1,293 @@
+package main
+
+import (
+	lib "./lib"
+
+	"github.com/Sirupsen/logrus"
+	"context"
+	"errors"
+	"path"
+	"strings"
+	"sync"
+)
+
+const cloneWorkers = 8
+
+type cloneJob struct {
+	status	lib.Clone
+	cancel	context.CancelFunc
+	done	chan struct{}
+}
+
+// cloneJobs tracks the clones of all volumes, running clones update their
+// progress from their own goroutine.
+type cloneJobs struct {
+	sync.Mutex
+	jobs	map[string]*cloneJob
+}
+
+func newCloneJobs() *cloneJobs {
+	return &cloneJobs{jobs: make(map[string]*cloneJob)}
+}
+
+// status returns a copy of the clone status of a volume, nil if it wasn't cloned.
+func (c *cloneJobs) status(name string) *lib.Clone {
+	c.Lock()
+	defer c.Unlock()
+
+	job, ok := c.jobs[name]
+	if(!ok) {
+		return nil
+	}
+	status := job.status
+	return &status
+}
+
+// restore adds the clone status of a volume read from the state file.
+func (c *cloneJobs) restore(name string, status lib.Clone) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.jobs[name] = &cloneJob{status: status}
+}
+
+// isSource reports whether a running clone reads from the volume.
+func (c *cloneJobs) isSource(name string) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	for _, job := range c.jobs {
+		if(job.status.Source == name && job.status.State == lib.CloneCopying) {
+			return true
+		}
+	}
+	return false
+}
+
+// stop cancels a running clone of the volume and waits for it, the clone
+// is failed afterwards so a partial copy isn't used.
+func (c *cloneJobs) stop(name string) {
+	c.Lock()
+	job, ok := c.jobs[name]
+	c.Unlock()
+
+	if(ok && job.cancel != nil) {
+		job.cancel()
+		<-job.done
+	}
+}
+
+// remove forgets the clone of a removed volume.
+func (c *cloneJobs) remove(name string) {
+	c.Lock()
+	defer c.Unlock()
+
+	delete(c.jobs, name)
+}
+
+func (c *cloneJobs) progress(name string, bytes int64) {
+	c.Lock()
+	defer c.Unlock()
+
+	if job, ok := c.jobs[name]; ok {
+		job.status.BytesCopied += uint64(bytes)
+	}
+}
+
+func (c *cloneJobs) report(name string, progress string) {
+	c.Lock()
+	defer c.Unlock()
+
+	if job, ok := c.jobs[name]; ok {
+		job.status.Progress = progress
+	}
+}
+
+func (c *cloneJobs) total(name string, bytes uint64) {
+	c.Lock()
+	defer c.Unlock()
+
+	if job, ok := c.jobs[name]; ok {
+		job.status.BytesTotal = bytes
+	}
+}
+
+func (c *cloneJobs) finish(name string, err error) {
+	c.Lock()
+	defer c.Unlock()
+
+	job, ok := c.jobs[name]
+	if(!ok) {
+		return
+	}
+	if(err != nil) {
+		job.status.State = lib.CloneFailed
+		job.status.Error = err.Error()
+	} else {
+		job.status.State = lib.CloneComplete
+		if(job.status.BytesTotal < job.status.BytesCopied) {
+			job.status.BytesTotal = job.status.BytesCopied
+		}
+	}
+}
+
+// cloneSource returns the volume and snapshot given by the from or
+// from_snapshot option of a new volume, nil if it isn't a clone.
+func (d *cephFSDriver) cloneSource(options map[string]string) (*lib.Volume, string, error) {
+	from, fromVolume := options["from"]
+	fromSnapshot, fromSnap := options["from_snapshot"]
+	if(fromVolume && fromSnap) {
+		return nil, "", errors.New(lib.INVALID_CLONE_SOURCE+"use either from or from_snapshot")
+	} else if(!fromVolume && !fromSnap) {
+		return nil, "", nil
+	}
+
+	snapshot := ""
+	if(fromSnap) {
+		var err error
+		from, snapshot, err = lib.ParseCloneSource(fromSnapshot)
+		if(err != nil) {
+			return nil, "", err
+		}
+	}
+
+	src := d.volume(from)
+	if(src == nil) {
+		return nil, "", errors.New(lib.UNABLE_FIND_VOLUME+from)
+	}
+	if(!d.cloneComplete(from)) {
+		return nil, "", errors.New(lib.CLONE_NOT_COMPLETE+from)
+	}
+	return src, snapshot, nil
+}
+
+// startClone fills a new volume from its source in the background. issued
+// tells that ceph already runs the server side clone of a subvolume, which
+// is only waited for. The result of the clone is saved in the state.
+func (d *cephFSDriver) startClone(vol lib.Volume, src lib.Volume, snapshot string, issued bool) {
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &cloneJob{
+		status: lib.Clone{
+			Source:   src.Name,
+			Snapshot: snapshot,
+			State:    lib.CloneCopying,
+		},
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	d.clones.Lock()
+	d.clones.jobs[vol.Name] = job
+	d.clones.Unlock()
+
+	go func() {
+		defer close(job.done)
+		defer cancel()
+
+		logrus.Info("Cloning ", src.Name, " into ", vol.Name, " ...")
+		var err error
+		if(subvolumeClone(vol, src) && issued) {
+			err = d.waitSubvolumeClone(ctx, vol)
+		} else if(subvolumeClone(vol, src)) {
+			err = d.runSubvolumeClone(ctx, vol, src, snapshot)
+		} else {
+			err = d.runClone(ctx, vol, src, snapshot)
+		}
+		if(err != nil) {
+			logrus.Error(err.Error())
+		} else {
+			logrus.Info("Clone of ", vol.Name, " complete")
+		}
+		d.clones.finish(vol.Name, err)
+		d.saveState()
+	}()
+}
+
+// runClone copies the source volume or its snapshot into the volume, both
+// filesystem roots are mounted separately so the clone doesn't depend on
+// container mounts.
+func (d *cephFSDriver) runClone(ctx context.Context, vol lib.Volume, src lib.Volume, snapshot string) error {
+	return d.withRootMount(ctx, src, func(srcRoot string) error {
+		dir := path.Join(srcRoot, src.Subpath)
+		if(len(snapshot) > 0) {
+			dir = path.Join(lib.SnapshotDir(srcRoot, src.Subpath), snapshot)
+			if(len(src.SubvolumeGroup) > 0) {
+				// Subvolume snapshots are taken above the data directory
+				dir = path.Join(lib.SnapshotDir(srcRoot, path.Dir(src.Subpath)), snapshot, path.Base(src.Subpath))
+			}
+			if(!lib.IsDirectory(dir)) {
+				return errors.New(lib.UNABLE_CLONE_VOLUME+"snapshot not found: "+src.Name+"@"+snapshot)
+			}
+		}
+
+		// CephFS knows the size of a directory tree up front
+		usage, err := lib.GetQuota(dir)
+		if(err == nil) {
+			d.clones.total(vol.Name, usage.Bytes)
+		}
+
+		return d.withRootMount(ctx, vol, func(dstRoot string) error {
+			return lib.CopyTree(ctx, dir, path.Join(dstRoot, vol.Subpath), cloneWorkers, func(bytes int64) {
+				d.clones.progress(vol.Name, bytes)
+			})
+		})
+	})
+}
+
+// resumeClones restarts the clones which were interrupted by a restart of
+// the plugin. A copy overwrites what was copied before, server side clones
+// which ceph already started or finished are only followed.
+func (d *cephFSDriver) resumeClones() {
+	for _, vol := range d.volumeList() {
+		status := d.clones.status(vol.Name)
+		if(status == nil || status.State != lib.CloneCopying) {
+			continue
+		}
+
+		src := d.volume(status.Source)
+		if(src == nil) {
+			d.clones.finish(vol.Name, errors.New(lib.UNABLE_FIND_VOLUME+status.Source))
+			d.saveState()
+			continue
+		}
+
+		issued := false
+		if(subvolumeClone(vol, *src)) {
+			cstatus, err := d.subvolumeCloneStatus(vol)
+			if(err == nil && cstatus.State != lib.CloneCopying) {
+				logrus.Info("Clone of ", vol.Name, " finished during the restart")
+				var cerr error
+				if(cstatus.State == lib.CloneFailed) {
+					cerr = errors.New(lib.UNABLE_CLONE_VOLUME+cstatus.Error)
+				}
+				d.clones.finish(vol.Name, cerr)
+				d.saveState()
+				continue
+			}
+			// Without a clone status the clone wasn't issued yet
+			issued = err == nil || !strings.Contains(err.Error(), "ENOENT")
+		}
+		logrus.Info("Resuming clone of ", vol.Name, " ...")
+		d.startClone(vol, *src, status.Snapshot, issued)
+	}
+}
+
+// cloneSourceName returns the name of the volume given by the from or
+// from_snapshot option, empty if there is none.
+func cloneSourceName(options map[string]string) string {
+	if from, ok := options["from"]; ok {
+		return from
+	}
+	if from, ok := options["from_snapshot"]; ok {
+		if i := strings.LastIndex(from, "@"); i > 0 {
+			return from[:i]
+		}
+	}
+	return ""
+}
+
+// cloneComplete reports whether the volume may be used, which is the case
+// unless its clone is running or failed.
+func (d *cephFSDriver) cloneComplete(name string) bool {
+	status := d.clones.status(name)
+	return status == nil || status.State == lib.CloneComplete
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	lib "./lib"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/go-plugins-helpers/volume"
+	"gopkg.in/yaml.v2"
+
+	"errors"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	defaultConfigFile = "/etc/docker-volume-cephfs/config.yml"
+	defaultClusterName = "default"
+)
+
+// Config of the plugin, read from the config file, the environment and the flags.
+// The top level monitors, auth, conf and filesystem describe the default
+// cluster which is used if no clusters are configured.
+type Config struct {
+	Path			string					`yaml:"path"`
+	Monitors		[]string				`yaml:"monitors"`
+	Auth			AuthConfig				`yaml:"auth"`
+	Conf			string					`yaml:"conf"`
+	Filesystem		string					`yaml:"filesystem"`
+	Clusters		map[string]ClusterConfig	`yaml:"clusters"`
+	DefaultCluster	string					`yaml:"default_cluster"`
+	MountType		string					`yaml:"mounttype"`
+	Backend			string					`yaml:"backend"`
+	SubvolumeGroup	string					`yaml:"subvolume_group"`
+	Naming			NamingConfig			`yaml:"naming"`
+	IndexRefresh	time.Duration			`yaml:"index_refresh"`
+	RootCheck		string					`yaml:"root_check"`
+	Options			map[string]string		`yaml:"options"`
+	Log				LogConfig				`yaml:"log"`
+}
+
+type ClusterConfig struct {
+	Monitors	[]string	`yaml:"monitors"`
+	Auth		AuthConfig	`yaml:"auth"`
+	Conf		string		`yaml:"conf"`
+	Filesystem	string		`yaml:"filesystem"`
+}
+
+type AuthConfig struct {
+	User		string	`yaml:"user"`
+	SecretFile	string	`yaml:"secretfile"`
+	Keyring		string	`yaml:"keyring"`
+}
+
+// NamingConfig maps volume names like "staging.dataio.fileStore" to the
+// nested directory /staging/dataio/fileStore.
+type NamingConfig struct {
+	Separator	string	`yaml:"separator"`
+	Depth		int		`yaml:"depth"`
+}
+
+type LogConfig struct {
+	Level	string	`yaml:"level"`
+	File	string	`yaml:"file"`
+}
+
+func DefaultConfiguration() Config {
+	return Config{
+		Path:      filepath.Join(volume.DefaultDockerRootDirectory, cephfsId),
+		Auth:      AuthConfig{
+			User:       "admin",
+			SecretFile: "/etc/ceph/admin.secretfile",
+		},
+		MountType: lib.MountTypeFuse,
+		Backend:   lib.BackendDirectory,
+		SubvolumeGroup: "docker",
+		Naming:    NamingConfig{Depth: 1},
+		IndexRefresh: time.Minute,
+		RootCheck: rootCheckWarn,
+		Options:   map[string]string{},
+		Log:       LogConfig{
+			Level: "error",
+			File:  logfile,
+		},
+	}
+}
+
+// LoadConfiguration applies the config file, then the environment and then
+// the flags on top of the defaults and validates the result. The arguments
+// after the flags are returned as well.
+func LoadConfiguration(args []string) (Config, []string, error) {
+	config := DefaultConfiguration()
+
+	flags := flag.NewFlagSet("docker-volume-cephfs", flag.ContinueOnError)
+	configFile := flags.String("config", "", "path of the config file (env CONFIG_FILE)")
+	path := flags.String("path", "", "plugin root directory")
+	monitor := flags.String("monitor", "", "comma separated ceph monitors")
+	user := flags.String("user", "", "ceph user")
+	secretfile := flags.String("secretfile", "", "ceph secret file")
+	fsname := flags.String("filesystem", "", "default ceph filesystem")
+	mountType := flags.String("mounttype", "", "default mount type, fuse or kernel")
+	backend := flags.String("backend", "", "volume backend, directory or subvolume")
+	subvolumeGroup := flags.String("subvolumegroup", "", "subvolume group of the subvolume backend")
+	indexRefresh := flags.Duration("indexrefresh", 0, "interval of the volume index refresh, 0 only refreshes on SIGHUP")
+	rootCheck := flags.String("rootcheck", "", "plugin root not on ceph, warn, refuse or mount")
+	logLevel := flags.String("loglevel", "", "log level, debug, info, warn or error")
+	err := flags.Parse(args)
+	if(err != nil) {
+		return config, nil, err
+	}
+
+	// Config file
+	file := *configFile
+	if(len(file) == 0) {
+		file = os.Getenv("CONFIG_FILE")
+	}
+	err = ConfigFileConfiguration(&config, file)
+	if(err != nil) {
+		return config, nil, err
+	}
+
+	// Environment
+	EnvironmentConfiguration(&config)
+
+	// Flags
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "path":
+			config.Path = *path
+		case "monitor":
+			config.Monitors = splitMonitors(*monitor)
+		case "user":
+			config.Auth.User = *user
+		case "secretfile":
+			config.Auth.SecretFile = *secretfile
+		case "filesystem":
+			config.Filesystem = *fsname
+		case "mounttype":
+			config.MountType = *mountType
+		case "backend":
+			config.Backend = *backend
+		case "subvolumegroup":
+			config.SubvolumeGroup = *subvolumeGroup
+		case "indexrefresh":
+			config.IndexRefresh = *indexRefresh
+		case "rootcheck":
+			config.RootCheck = *rootCheck
+		case "loglevel":
+			config.Log.Level = *logLevel
+		}
+	})
+
+	err = config.Validate()
+	if(err != nil) {
+		return config, nil, err
+	}
+
+	return config, flags.Args(), nil
+}
+
+// ConfigFileConfiguration reads the YAML config file. Without an explicit
+// file the default location is used if it exists.
+func ConfigFileConfiguration(config *Config, file string) error {
+	explicit := len(file) > 0
+	if(!explicit) {
+		file = defaultConfigFile
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if(os.IsNotExist(err) && !explicit) {
+		return nil
+	} else if(err != nil) {
+		return errors.New(lib.UNABLE_READ_CONFIG+err.Error())
+	}
+
+	err = yaml.UnmarshalStrict(data, config)
+	if(err != nil) {
+		return errors.New(lib.UNABLE_READ_CONFIG+file+": "+err.Error())
+	}
+
+	return nil
+}
+
+// EnvironmentConfiguration overrides the config with all environment variables which are set.
+func EnvironmentConfiguration(config *Config) {
+	if val := os.Getenv("DEFAULT_PATH"); len(val) > 0 {
+		config.Path = val
+	}
+	if val := os.Getenv("DEFAULT_MONITOR"); len(val) > 0 {
+		config.Monitors = splitMonitors(val)
+	}
+	if val := os.Getenv("CEPH_USER"); len(val) > 0 {
+		config.Auth.User = val
+	}
+	if val := os.Getenv("CEPH_SECRETFILE"); len(val) > 0 {
+		config.Auth.SecretFile = val
+	}
+	if val := os.Getenv("CEPH_FILESYSTEM"); len(val) > 0 {
+		config.Filesystem = val
+	}
+	if val := os.Getenv("CEPH_MOUNT_TYPE"); len(val) > 0 {
+		config.MountType = val
+	}
+	if val := os.Getenv("CEPH_BACKEND"); len(val) > 0 {
+		config.Backend = val
+	}
+	if val := os.Getenv("CEPH_SUBVOLUME_GROUP"); len(val) > 0 {
+		config.SubvolumeGroup = val
+	}
+	if val := os.Getenv("ROOT_CHECK"); len(val) > 0 {
+		config.RootCheck = val
+	}
+	if val := os.Getenv("LOG_LEVEL"); len(val) > 0 {
+		config.Log.Level = val
+	}
+}
+
+// Validate checks the config for missing or invalid values.
+func (c Config) Validate() error {
+	if(!filepath.IsAbs(c.Path)) {
+		return errors.New(lib.INVALID_CONFIG+"path must be absolute: "+c.Path)
+	}
+	if(!lib.ValidMountType(c.MountType)) {
+		return errors.New(lib.INVALID_CONFIG+lib.INVALID_MOUNT_TYPE+c.MountType)
+	}
+
+	if(c.Backend != lib.BackendDirectory && c.Backend != lib.BackendSubvolume) {
+		return errors.New(lib.INVALID_CONFIG+lib.INVALID_BACKEND+c.Backend)
+	}
+	if(c.Backend == lib.BackendSubvolume && len(c.SubvolumeGroup) == 0) {
+		return errors.New(lib.INVALID_CONFIG+"the subvolume backend needs a subvolume group")
+	}
+
+	if(c.Naming.Depth < 1) {
+		return errors.New(lib.INVALID_CONFIG+"naming depth must be at least 1")
+	}
+	if(c.Naming.Depth > 1 && len(c.Naming.Separator) == 0) {
+		return errors.New(lib.INVALID_CONFIG+"nested naming needs a separator")
+	}
+	if(strings.Trim(c.Naming.Separator, "_.-") != "") {
+		return errors.New(lib.INVALID_CONFIG+"naming separator may only contain _ . and -: "+c.Naming.Separator)
+	}
+
+	if(c.IndexRefresh < 0) {
+		return errors.New(lib.INVALID_CONFIG+"index refresh must not be negative: "+c.IndexRefresh.String())
+	}
+
+	if(c.RootCheck != rootCheckWarn && c.RootCheck != rootCheckRefuse && c.RootCheck != rootCheckMount) {
+		return errors.New(lib.INVALID_CONFIG+"root check must be warn, refuse or mount: "+c.RootCheck)
+	}
+
+	clusters := c.ClusterRegistry()
+	if _, ok := clusters[c.DefaultClusterName()]; !ok {
+		return errors.New(lib.INVALID_CONFIG+lib.UNKNOWN_CLUSTER+c.DefaultClusterName())
+	}
+	for name, cluster := range clusters {
+		if(c.MountType == lib.MountTypeKernel && len(cluster.Monitors) == 0) {
+			return errors.New(lib.INVALID_CONFIG+"kernel mounts need at least one monitor, cluster: "+name)
+		}
+		if(len(cluster.User) == 0) {
+			return errors.New(lib.INVALID_CONFIG+"auth user is missing, cluster: "+name)
+		}
+	}
+	if _, err := parseLogLevel(c.Log.Level); err != nil {
+		return errors.New(lib.INVALID_CONFIG+err.Error())
+	}
+	return nil
+}
+
+// ClusterRegistry returns all configured clusters by name, the top level
+// settings form the cluster "default" if no clusters are configured.
+func (c Config) ClusterRegistry() map[string]lib.Cluster {
+	clusters := make(map[string]lib.Cluster)
+	if(len(c.Clusters) == 0) {
+		clusters[defaultClusterName] = lib.Cluster{
+			Name:       defaultClusterName,
+			Monitors:   c.Monitors,
+			User:       c.Auth.User,
+			SecretFile: c.Auth.SecretFile,
+			Keyring:    c.Auth.Keyring,
+			ConfPath:   c.Conf,
+			Filesystem: c.Filesystem,
+		}
+		return clusters
+	}
+
+	for name, cc := range c.Clusters {
+		cluster := lib.Cluster{
+			Name:       name,
+			Monitors:   cc.Monitors,
+			User:       cc.Auth.User,
+			SecretFile: cc.Auth.SecretFile,
+			Keyring:    cc.Auth.Keyring,
+			ConfPath:   cc.Conf,
+			Filesystem: cc.Filesystem,
+		}
+		// Unset values fall back to the top level settings
+		if(len(cluster.User) == 0) {
+			cluster.User = c.Auth.User
+		}
+		// A cluster without own credentials uses the top level keyring or
+		// secret file, an own secret file isn't overridden by the keyring
+		if(len(cluster.Keyring) == 0 && len(cluster.SecretFile) == 0) {
+			cluster.Keyring = c.Auth.Keyring
+			cluster.SecretFile = c.Auth.SecretFile
+		}
+		if(len(cluster.Filesystem) == 0) {
+			cluster.Filesystem = c.Filesystem
+		}
+		clusters[name] = cluster
+	}
+	return clusters
+}
+
+// DefaultClusterName returns the cluster used for volumes without a cluster option.
+func (c Config) DefaultClusterName() string {
+	if(len(c.DefaultCluster) > 0) {
+		return c.DefaultCluster
+	}
+	if(len(c.Clusters) == 1) {
+		for name := range c.Clusters {
+			return name
+		}
+	}
+	return defaultClusterName
+}
+
+// ApplyLogLevel sets the logrus level from the config.
+func (c Config) ApplyLogLevel() {
+	level, _ := parseLogLevel(c.Log.Level)
+	logrus.SetLevel(level)
+}
+
+// parseLogLevel accepts logrus level names and the numeric LOG_LEVEL values 0-3.
+func parseLogLevel(level string) (logrus.Level, error) {
+	switch level {
+	case "3":
+		return logrus.DebugLevel, nil
+	case "2":
+		return logrus.InfoLevel, nil
+	case "1":
+		return logrus.WarnLevel, nil
+	case "0", "":
+		return logrus.ErrorLevel, nil
+	}
+	return logrus.ParseLevel(level)
+}
+
+func splitMonitors(monitor string) []string {
+	return strings.FieldsFunc(monitor, func(r rune) bool {
+		return r == ',' || r == ';' || r == ' '
+	})
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	lib "./lib"
+
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func writeConfigFile(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "cephfs-config")
+	if(err != nil) {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	file := path.Join(dir, "config.yml")
+	if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestLoadConfigurationPrecedence(t *testing.T) {
+	file := writeConfigFile(t, `
+path: /var/lib/cephfs
+monitors: [mon1, mon2]
+auth:
+  user: file-user
+  secretfile: /etc/ceph/file.secret
+filesystem: cephfs
+mounttype: kernel
+options:
+  quota_bytes: "1024"
+log:
+  level: info
+`)
+	os.Setenv("CEPH_USER", "env-user")
+	os.Setenv("CEPH_SECRETFILE", "/etc/ceph/env.secret")
+	defer os.Unsetenv("CEPH_USER")
+	defer os.Unsetenv("CEPH_SECRETFILE")
+
+	config, _, err := LoadConfiguration([]string{"-config", file, "-secretfile", "/etc/ceph/flag.secret"})
+
+	assert.Nil(t, err)
+	assert.Equal(t, "/var/lib/cephfs", config.Path)
+	assert.Equal(t, "mon1,mon2", config.ClusterRegistry()["default"].Monitor())
+	assert.Equal(t, "env-user", config.Auth.User)
+	assert.Equal(t, "/etc/ceph/flag.secret", config.Auth.SecretFile)
+	assert.Equal(t, "cephfs", config.Filesystem)
+	assert.Equal(t, lib.MountTypeKernel, config.MountType)
+	assert.Equal(t, map[string]string{"quota_bytes": "1024"}, config.Options)
+	assert.Equal(t, "info", config.Log.Level)
+}
+
+func TestLoadConfigurationDefaults(t *testing.T) {
+	config, _, err := LoadConfiguration([]string{"-config", writeConfigFile(t, "")})
+
+	assert.Nil(t, err)
+	assert.Equal(t, DefaultConfiguration(), config)
+}
+
+func TestLoadConfigurationInvalid(t *testing.T) {
+	tests := []struct {
+		name	string
+		content	string
+	}{
+		{"relative path", "path: relative/dir"},
+		{"mount type", "mounttype: nfs"},
+		{"kernel without monitors", "mounttype: kernel"},
+		{"log level", "log:\n  level: loud"},
+		{"backend", "backend: rbd"},
+		{"naming without separator", "naming:\n  depth: 3"},
+		{"naming separator", "naming:\n  separator: /\n  depth: 3"},
+		{"index refresh", "index_refresh: -1m"},
+		{"root check", "root_check: ignore"},
+		{"subvolume group", "backend: subvolume\nsubvolume_group: \"\""},
+		{"unknown key", "monitor: mon1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, err := LoadConfiguration([]string{"-config", writeConfigFile(t, test.content)})
+			assert.NotNil(t, err)
+		})
+	}
+
+	_, _, err := LoadConfiguration([]string{"-config", "/dont/exists.yml"})
+	assert.NotNil(t, err)
+}
+
+func TestClusterRegistryCredentials(t *testing.T) {
+	file := writeConfigFile(t, `
+auth:
+  user: docker
+  keyring: /etc/ceph/ceph.client.docker.keyring
+default_cluster: prod
+clusters:
+  prod:
+    monitors: [prod-mon1]
+  staging:
+    monitors: [staging-mon1]
+    auth:
+      secretfile: /etc/ceph/staging.secret
+`)
+	config, _, err := LoadConfiguration([]string{"-config", file})
+	assert.Nil(t, err)
+
+	clusters := config.ClusterRegistry()
+	assert.Equal(t, "docker", clusters["prod"].User)
+	assert.Equal(t, "/etc/ceph/ceph.client.docker.keyring", clusters["prod"].Keyring)
+	// An own secret file isn't overridden by the default keyring
+	assert.Equal(t, "", clusters["staging"].Keyring)
+	assert.Equal(t, "/etc/ceph/staging.secret", clusters["staging"].SecretFile)
+}
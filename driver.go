@@ -5,75 +5,479 @@ import (
 
 	"github.com/Sirupsen/logrus"
 	"github.com/docker/go-plugins-helpers/volume"
+	"context"
 	"errors"
+	"io/ioutil"
 	"os"
 	"strings"
 	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
 )
 
 
+const (
+	stateFile = "state.json"
+	mountsDir = "mounts"
+	requestTimeout = 5 * time.Minute
+)
+
 type cephFSDriver struct { volume.Driver
+	runner		lib.CommandRunner
+	inspector	lib.MountInspector
 	defaultPath	string
+	stateFile	string
 	volumes		lib.VolumeList
-	monitor 	string
-	user 		string
-	secretfile	string
+	mounts		map[string]map[string]bool
+	adopted		map[string]bool
+	clusters	map[string]lib.Cluster
+	defaultCluster	string
+	mountType	string
+	backend		string
+	subvolumeGroup	string
+	naming		lib.Naming
+	options		map[string]string
+	clones		*cloneJobs
+	index		*volumeIndex
+	manage		*managementMounts
+	health		*healthStates
+	// lock guards volumes and mounts, locks serializes the requests on
+	// each volume
+	lock		*sync.RWMutex
+	locks		*lib.KeyedMutex
 }
 
 /**
 
  */
-func newCephFSDriver( defaultPath  string, monitor string, user string, secretfile string) (cephFSDriver, error) {
+func newCephFSDriver( runner lib.CommandRunner, config Config) (cephFSDriver, error) {
+	d, err := loadCephFSDriver(runner, config)
+	if(err != nil) {
+		return cephFSDriver{}, err
+	}
+
+	ctx, cancel := d.newContext()
+	defer cancel()
+
+	// Mounts of a previous run are adopted or cleaned up
+	d.reconcileMounts(ctx)
+
+	// The first refresh of the index discovers the volumes
+	err = d.refreshIndex(ctx)
+	if (err != nil) {
+		return cephFSDriver{}, err
+	}
+
+	for _, vol := range d.index.volumes() {
+		if(d.volumes.ByName(vol.Name) != nil) {
+			// Already restored from the state file
+			continue
+		}
+		// Only volumes with a local mountpoint are restored
+		mountpoint := d.mountpoint(vol.Name)
+		if (lib.IsDirectory(mountpoint)) {
+			vol.Filesystem.Path = mountpoint
+
+			d.volumes = append(d.volumes, vol)
+		}
+	}
+
+	d.saveState()
+	d.resumeClones()
+
+	return d, nil
+}
+
+// loadCephFSDriver creates a driver which only knows the volumes of the
+// state file, without looking at the clusters.
+func loadCephFSDriver( runner lib.CommandRunner, config Config) (cephFSDriver, error) {
+	defaultPath := config.Path
 	d := cephFSDriver{
+		runner:      runner,
+		inspector:   lib.MountInspector{MountInfo: mountInfoFile, Statfs: lib.TimeoutStatfs(statfs, mountCheckTimeout)},
 		defaultPath: defaultPath,
+		stateFile:   path.Join(defaultPath, stateFile),
 		volumes:     nil,
-		monitor:     monitor,
-		user:        user,
-		secretfile:  secretfile,
+		mounts:      make(map[string]map[string]bool),
+		adopted:     make(map[string]bool),
+		clusters:    config.ClusterRegistry(),
+		defaultCluster: config.DefaultClusterName(),
+		mountType:   config.MountType,
+		backend:     config.Backend,
+		subvolumeGroup: config.SubvolumeGroup,
+		naming:      lib.Naming{Separator: config.Naming.Separator, Depth: config.Naming.Depth},
+		options:     config.Options,
+		clones:      newCloneJobs(),
+		index:       newVolumeIndex(config.IndexRefresh),
+		manage:      newManagementMounts(),
+		health:      newHealthStates(),
+		lock:        &sync.RWMutex{},
+		locks:       lib.NewKeyedMutex(),
 	}
 
-	filesystems, err := lib.GetCephFilesystems(path.Join(defaultPath, "tmp"))
+	if(!lib.ValidMountType(d.mountType)) {
+		return cephFSDriver{}, errors.New(lib.INVALID_MOUNT_TYPE+d.mountType)
+	}
 
+	err := d.loadState()
 	if(err != nil) {
-		return cephFSDriver{}, errors.New(lib.REQUEST_FILESYSTEM_ERROR+err.Error())
+		return cephFSDriver{}, err
 	}
 
-	for _, fs := range filesystems {
+	return d, nil
+}
+
+// withSubvolumes adds the subvolumes to the volumes found in the filesystem
+// roots when the subvolume backend is used.
+func (d *cephFSDriver) withSubvolumes(ctx context.Context, cluster lib.Cluster, vols lib.VolumeList) (lib.VolumeList, error) {
+	if(d.backend != lib.BackendSubvolume) {
+		return vols, nil
+	}
 
-		fs.Path = path.Join(defaultPath, "tmp")
+	// Directories in the tree holding the subvolumes aren't volumes
+	var dirs lib.VolumeList
+	for _, vol := range vols {
+		if(strings.SplitN(strings.TrimPrefix(vol.Subpath, "/"), "/", 2)[0] != lib.SubvolumeRoot) {
+			dirs = append(dirs, vol)
+		}
+	}
+	vols = dirs
+	subvols, err := lib.GetSubvolumes(ctx, d.runner, cluster, d.subvolumeGroup, d.mountType)
+	if(err != nil) {
+		return nil, err
+	}
+	return append(vols, subvols...), nil
+}
 
-		vols, err := fs.GetVolumes(monitor, user, secretfile)
+// mountpoint returns the directory containers use a volume through.
+func (d *cephFSDriver) mountpoint(name string) string {
+	return path.Join(d.defaultPath, mountsDir, name)
+}
 
-		if (err != nil) {
-			return cephFSDriver{}, errors.New(lib.UNABLE_GET_VOLUMES + err.Error())
+// copyVolume returns a copy of a volume which doesn't share its options.
+func copyVolume(vol lib.Volume) lib.Volume {
+	if(vol.Options != nil) {
+		options := make(map[string]string)
+		for key, val := range vol.Options {
+			options[key] = val
 		}
+		vol.Options = options
+	}
+	return vol
+}
 
-		for _, vol := range vols {
-			if (lib.IsDirectory(path.Join(defaultPath, vol.Name))) {
-				vol.Filesystem = fs
-				vol.Filesystem.Path = path.Join(defaultPath, vol.Name)
+// volume returns a copy of a known volume, nil if there is none.
+func (d *cephFSDriver) volume(name string) *lib.Volume {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
 
-				d.volumes = append(d.volumes, vol)
-			}
+	vol := d.volumes.ByName(name)
+	if(vol == nil) {
+		return nil
+	}
+	cvol := copyVolume(*vol)
+	return &cvol
+}
+
+// volumeList returns a copy of all known volumes.
+func (d *cephFSDriver) volumeList() lib.VolumeList {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	vols := make(lib.VolumeList, 0, len(d.volumes))
+	for _, vol := range d.volumes {
+		vols = append(vols, copyVolume(vol))
+	}
+	return vols
+}
+
+// addVolume adds a new volume or replaces a known one with the same name.
+func (d *cephFSDriver) addVolume(vol lib.Volume) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if known := d.volumes.ByName(vol.Name); known != nil {
+		*known = vol
+		return
+	}
+	d.volumes = append(d.volumes, vol)
+}
+
+// replaceVolume updates a known volume.
+func (d *cephFSDriver) replaceVolume(vol lib.Volume) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if known := d.volumes.ByName(vol.Name); known != nil {
+		*known = vol
+	}
+}
+
+// removeVolume forgets a volume and its mount IDs.
+func (d *cephFSDriver) removeVolume(name string) {
+	d.lock.Lock()
+	d.volumes = d.volumes.Remove(name)
+	delete(d.mounts, name)
+	d.lock.Unlock()
+
+	d.index.remove(name)
+	d.health.remove(name)
+	d.clones.remove(name)
+}
+
+// mountCount returns the number of containers using a volume.
+func (d *cephFSDriver) mountCount(name string) int {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	return len(d.mounts[name])
+}
+
+// mountIDs returns the sorted IDs of the containers using a volume.
+func (d *cephFSDriver) mountIDs(name string) []string {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	ids := []string{}
+	for id := range d.mounts[name] {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// addMount records a container using a volume.
+func (d *cephFSDriver) addMount(name string, id string) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	ids, ok := d.mounts[name]
+	if(!ok) {
+		ids = make(map[string]bool)
+		d.mounts[name] = ids
+	}
+	ids[id] = true
+}
+
+// releaseMount forgets a container using a volume and returns whether the
+// mount ID was known and how many mounts remain. Unknown IDs are ignored
+// while the volume has other mounts.
+func (d *cephFSDriver) releaseMount(name string, id string) (bool, int) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	ids := d.mounts[name]
+	if(len(ids) > 0 && !ids[id]) {
+		return false, len(ids)
+	}
+	delete(ids, id)
+	if(len(ids) == 0) {
+		delete(d.mounts, name)
+	}
+	return true, len(ids)
+}
+
+// clusterList returns all clusters ordered by name.
+func (d *cephFSDriver) clusterList() []lib.Cluster {
+	var names []string
+	for name := range d.clusters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var clusters []lib.Cluster
+	for _, name := range names {
+		clusters = append(clusters, d.clusters[name])
+	}
+	return clusters
+}
+
+// cluster returns the cluster of a volume, volumes without one belong to the default cluster.
+func (d *cephFSDriver) cluster(vol lib.Volume) (lib.Cluster, error) {
+	name := vol.Cluster
+	if(len(name) == 0) {
+		name = d.defaultCluster
+	}
+	cluster, ok := d.clusters[name]
+	if(!ok) {
+		return lib.Cluster{}, errors.New(lib.UNKNOWN_CLUSTER+name)
+	}
+	return cluster, nil
+}
+
+// mountCluster returns the cluster of a volume with the credentials given
+// in the volume options, these are only used to mount the volume itself.
+func (d *cephFSDriver) mountCluster(vol lib.Volume) (lib.Cluster, error) {
+	cluster, err := d.cluster(vol)
+	if(err != nil) {
+		return cluster, err
+	}
+
+	if user, ok := vol.Options["user"]; ok {
+		cluster.User = user
+	}
+	if keyring, ok := vol.Options["keyring"]; ok {
+		cluster.Keyring = keyring
+		cluster.SecretFile = ""
+	}
+	if secretfile, ok := vol.Options["secretfile"]; ok {
+		cluster.SecretFile = secretfile
+		cluster.Keyring = ""
+	}
+	if secret, ok := vol.Options["secret"]; ok {
+		// The docker secret may contain a plain key or a keyring
+		file, err := lib.DockerSecretPath(secret)
+		if(err != nil) {
+			return cluster, err
 		}
+		cluster.SecretFile = file
+		cluster.Keyring = ""
+	}
+
+	return cluster, nil
+}
 
+// newContext bounds all commands run for a single request.
+func (d *cephFSDriver) newContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), requestTimeout)
+}
+
+// withRootMount mounts the root of the filesystem of a volume with the admin
+// credentials on a temporary directory and runs fn with it.
+func (d *cephFSDriver) withRootMount(ctx context.Context, vol lib.Volume, fn func(root string) error) error {
+	cluster, err := d.cluster(vol)
+	if(err != nil) {
+		return err
 	}
 
-	return d, nil
+	err = os.MkdirAll(d.defaultPath, os.ModePerm)
+	if(err != nil) {
+		return errors.New(lib.UNABLE_CREATE_DIR+err.Error())
+	}
+	root, err := ioutil.TempDir(d.defaultPath, "root-")
+	if(err != nil) {
+		return errors.New(lib.UNABLE_CREATE_DIR+err.Error())
+	}
+	defer os.Remove(root)
+
+	fsvol := lib.Volume{
+		Name: "root",
+		Subpath: "/",
+		Filesystem: vol.Filesystem,
+		MountType: d.mountType,
+	}
+	fsvol.Filesystem.Path = root
+	err = fsvol.Mount(ctx, d.runner, cluster)
+	if(err != nil) {
+		return err
+	}
+
+	err = fn(root)
+
+	uerr := fsvol.Unmount(ctx, d.runner)
+	if(err == nil) {
+		err = uerr
+	}
+	return err
+}
+
+// loadState restores the volumes and their mount IDs from the state file
+// and drops mount IDs of volumes which aren't mounted anymore.
+func (d *cephFSDriver) loadState() error {
+	logrus.Info("Loading state from ", d.stateFile, " ...")
+	state, err := lib.LoadState(d.stateFile)
+	if(err != nil) {
+		logrus.Error(err.Error())
+		return err
+	}
+
+	for _, vs := range state.Volumes {
+		if(len(vs.Volume.MountType) == 0) {
+			vs.Volume.MountType = d.mountType
+		}
+		if(len(vs.Volume.Cluster) == 0) {
+			vs.Volume.Cluster = d.defaultCluster
+		}
+		if _, ok := vs.Volume.Options["path"]; !ok && len(vs.MountIDs) == 0 {
+			// Volumes of older versions were mounted on their creation directory
+			vs.Volume.Filesystem.Path = d.mountpoint(vs.Volume.Name)
+		}
+		d.volumes = append(d.volumes, vs.Volume)
+		if(vs.Clone != nil) {
+			d.clones.restore(vs.Volume.Name, *vs.Clone)
+		}
+
+		if(len(vs.MountIDs) == 0) {
+			continue
+		}
+		if(!lib.IsMountpoint(vs.Volume.Filesystem.Path)) {
+			logrus.Warn("Volume ", vs.Volume.Name, " isn't mounted anymore, dropping ", len(vs.MountIDs), " mount(s)")
+			continue
+		}
+		ids := make(map[string]bool)
+		for _, id := range vs.MountIDs {
+			ids[id] = true
+		}
+		d.mounts[vs.Volume.Name] = ids
+	}
+
+	return nil
+}
+
+// saveState writes all volumes and their mount IDs to the state file. The
+// lock is held while writing so concurrent saves can't reorder.
+func (d *cephFSDriver) saveState() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	state := lib.State{}
+	for _, vol := range d.volumes {
+		vs := lib.VolumeState{Volume: vol, Clone: d.clones.status(vol.Name)}
+		for id := range d.mounts[vol.Name] {
+			vs.MountIDs = append(vs.MountIDs, id)
+		}
+		state.Volumes = append(state.Volumes, vs)
+	}
+
+	err := state.Save(d.stateFile)
+	if(err != nil) {
+		logrus.Error(err.Error())
+	}
 }
 
 func (d *cephFSDriver ) Create( r *volume.CreateRequest ) error {
-	logrus.Info("--- Create Called ", r.Name, " ", r.Options)
+	logrus.Info("--- Create Called ", r.Name, " ", lib.RedactOptions(r.Options))
 	defer logrus.Info("--- Create End")
 
+	ctx, cancel := d.newContext()
+	defer cancel()
+
+	// Default options from the config apply unless given explicitly
+	options := make(map[string]string)
+	for key, val := range d.options {
+		options[key] = val
+	}
+	for key, val := range r.Options {
+		options[key] = val
+	}
+
+	// The source of a clone can't be removed while the clone starts
+	unlock := d.locks.Lock(r.Name, cloneSourceName(options))
+	defer unlock()
+
 	cvol := lib.Volume{
 		Name:		r.Name,
 		Subpath:	"",
+		Options:	options,
+		Cluster:	d.defaultCluster,
+		MountType:	d.mountType,
 	}
 
 	logrus.Info("Processing options ...")
 	// Process Options
-	for key, val := range r.Options {
+	for key, val := range options {
 		switch key {
 			case "datapool":
 				cvol.Filesystem.DataPool = val
@@ -85,23 +489,102 @@ func (d *cephFSDriver ) Create( r *volume.CreateRequest ) error {
 				cvol.Filesystem.Path = val
 			case "subpath":
 				cvol.Subpath = val
+			case "mounttype":
+				cvol.MountType = val
+			case "cluster":
+				cvol.Cluster = val
+			case "snapshot_keep_hourly", "snapshot_keep_daily":
+				if err := validSnapshotRetention(val); err != nil {
+					logrus.Error(err.Error())
+					return err
+				}
+			case "authorize":
+				if _, err := strconv.ParseBool(val); err != nil {
+					err = errors.New(lib.INVALID_AUTHORIZE+val)
+					logrus.Error(err.Error())
+					return err
+				}
+			case "quota_bytes":
+				quota, err := lib.ParseQuota(val)
+				if(err != nil) {
+					logrus.Error(err.Error())
+					return err
+				}
+				cvol.Quota.MaxBytes = quota
+			case "quota_files":
+				quota, err := lib.ParseQuota(val)
+				if(err != nil) {
+					logrus.Error(err.Error())
+					return err
+				}
+				cvol.Quota.MaxFiles = quota
 		}
 	}
 
+	if(d.backend == lib.BackendSubvolume) {
+		if _, ok := options["subpath"]; ok {
+			err := errors.New(lib.SUBPATH_WITH_SUBVOLUME)
+			logrus.Error(err.Error())
+			return err
+		}
+		cvol.SubvolumeGroup = d.subvolumeGroup
+	}
+
+	cluster, err := d.cluster(cvol)
+	if(err != nil) {
+		logrus.Error(err.Error())
+		return err
+	}
+	if(len(cvol.Filesystem.Name) == 0) {
+		cvol.Filesystem.Name = cluster.Filesystem
+	}
+
 	// Validate required options
 	if(len(cvol.Filesystem.Name) == 0) {
 		//Required options must be set
 		return errors.New(lib.REQUIRED_OPTIONS)
 	}
+	if(!lib.ValidMountType(cvol.MountType)) {
+		err := errors.New(lib.INVALID_MOUNT_TYPE+cvol.MountType)
+		logrus.Error(err.Error())
+		return err
+	}
+
+	// Validate the clone source
+	src, snapshot, err := d.cloneSource(options)
+	if(err != nil) {
+		logrus.Error(err.Error())
+		return err
+	}
+
+	// Validate per volume credentials
+	if(hasCredentialOptions(options)) {
+		mcluster, err := d.mountCluster(cvol)
+		if(err == nil) {
+			_, err = mcluster.Key()
+		}
+		if(err != nil) {
+			logrus.Error(err.Error())
+			return err
+		}
+	}
 
 	// Process empty options
-	if(len(cvol.Subpath) == 0) {
-		cvol.Subpath = "/"+cvol.Name
-	} else if(strings.Index(cvol.Subpath, "/") > 0) {
-		cvol.Subpath = "/"+cvol.Subpath
+	if(len(cvol.Subpath) > 0) {
+		cvol.Subpath, err = lib.NormalizeSubpath(cvol.Subpath)
+	} else if(len(cvol.SubvolumeGroup) > 0) {
+		// Replaced by the path of the subvolume
+		cvol.Subpath, err = lib.NormalizeSubpath(cvol.Name)
+	} else {
+		// The volume name gives the directory
+		cvol.Subpath, err = d.naming.Subpath(cvol.Name)
+	}
+	if(err != nil) {
+		logrus.Error(err.Error())
+		return err
 	}
 	if(len(cvol.Filesystem.Path) == 0) {
-		cvol.Filesystem.Path = d.defaultPath+cvol.Subpath
+		cvol.Filesystem.Path = d.mountpoint(cvol.Name)
 	}
 
 	// Create path directory if needed
@@ -117,7 +600,7 @@ func (d *cephFSDriver ) Create( r *volume.CreateRequest ) error {
 	}
 
 	logrus.Info("Checking filesystem ...")
-	exists, err := cvol.Filesystem.Exists()
+	exists, err := cvol.Filesystem.Exists(ctx, d.runner, cluster)
 	if(err != nil) {
 		logrus.Error(err.Error())
 		return err
@@ -131,7 +614,8 @@ func (d *cephFSDriver ) Create( r *volume.CreateRequest ) error {
 			return err
 		}
 
-		_, err = lib.NewFilesystem(cvol.Filesystem.Name,
+		_, err = lib.NewFilesystem(ctx, d.runner, cluster,
+										cvol.Filesystem.Name,
 										cvol.Filesystem.Path,
 										cvol.Filesystem.DataPool,
 										cvol.Filesystem.MetaPool)
@@ -142,45 +626,46 @@ func (d *cephFSDriver ) Create( r *volume.CreateRequest ) error {
 		}
 	}
 
-	logrus.Info("Mounting filesystem ...")
-	// Mount filesystem
-	fsvol := lib.Volume{
-		Name: "root",
-		Subpath: "/",
-		Filesystem: cvol.Filesystem,
+	var created bool
+	if(len(cvol.SubvolumeGroup) > 0) {
+		created, err = d.createSubvolume(ctx, cluster, &cvol, src)
+	} else {
+		created, err = d.createDirectory(ctx, cvol)
+	}
+	if(err != nil) {
+		logrus.Error(err.Error())
+		return err
 	}
-	fsvol.Mount(d.monitor, d.user, d.secretfile)
 
-	logrus.Info("Checking volume ...")
-	// Check if volume already exists
-	// Create new volume if it doesn't exist
-	if(!lib.IsDirectory(cvol.Filesystem.Path+cvol.Subpath)) {
-		logrus.Info("Creating new volume ...")
-		err = os.MkdirAll(cvol.Filesystem.Path+cvol.Subpath, os.ModePerm)
+	// Create a ceph client restricted to the volume, a cloned subvolume
+	// gets it once its path is known
+	if(authorized(cvol) && len(cvol.Subpath) > 0) {
+		logrus.Info("Creating ceph client ...")
+		err = d.authorizeClient(ctx, cluster, &cvol)
 		if(err != nil) {
-			err = errors.New(lib.UNABLE_CREATE_DIR+err.Error())
 			logrus.Error(err.Error())
+			if(created) {
+				d.rollbackCreate(ctx, cluster, cvol)
+			}
 			return err
 		}
 	}
 
-	logrus.Info("Unmounting filesystem ...")
-	// Unmount Filesystem
-	err = fsvol.Unmount()
-	if(err != nil) {
-		logrus.Error(err.Error())
-		return err
-	}
-
 	///logrus.Info("Mounting volume ...")
 	// Mount Volume
-	///err = cvol.Mount(d.monitor, d.user, d.secretfile)
+	///err = cvol.Mount(ctx, d.runner, cluster)
 	///if(err != nil) {
 	///	logrus.Error(err.Error())
 	///	return err
 	///}
 
-	d.volumes = append(d.volumes, cvol)
+	d.addVolume(cvol)
+	d.index.add(copyVolume(cvol))
+	if(src != nil) {
+		// Progress of the clone is shown in the status of the volume
+		d.startClone(cvol, *src, snapshot, false)
+	}
+	d.saveState()
 
 	return nil
 }
@@ -189,15 +674,22 @@ func( d *cephFSDriver ) List() (*volume.ListResponse, error) {
 	logrus.Info("List Called ")
 	defer logrus.Info("List End")
 
-	// Get volumes
+	// Get volumes of all clusters from the index, it is only refreshed here
+	// until every cluster could be listed once
 	logrus.Info("Getting all volumes ...")
-	vols, err := lib.GetVolumes(d.monitor, d.user, d.secretfile, d.defaultPath)
-	if (err != nil) {
-		logrus.Error(err.Error())
-		return nil, err
+	if(!d.index.loaded(d.clusterList())) {
+		ctx, cancel := d.newContext()
+		defer cancel()
+		err := d.refreshIndex(ctx)
+		if (err != nil) {
+			return nil, err
+		}
 	}
+	vols := d.index.volumes()
+	local := d.volumeList()
+	now := time.Now()
 	logrus.Debug(vols)
-	logrus.Debug(d.volumes)
+	logrus.Debug(local)
 
 	logrus.Info("Converting volume list ...")
 	var vvols []*volume.Volume
@@ -205,25 +697,20 @@ func( d *cephFSDriver ) List() (*volume.ListResponse, error) {
 	mountpoint := ""
 	status := ""
 	for _, vol := range vols {
-		local := d.volumes.ByName(vol.Name)
-		if(local != nil) {
-			if (lib.IsDirectory(local.Filesystem.Path)) {
-				mountpoint = local.Filesystem.Path
-			}
-			status = "ceph+local"
-		} else {
-			status = "ceph"
+		if(local.ByName(vol.Name) != nil) {
+			// Listed with the local volumes below
+			continue
 		}
+		status = "ceph"
 		vvols = append(vvols, &volume.Volume{
 									Name: vol.Name,
 									Mountpoint: mountpoint,
-									Status: map[string]interface{}{"location":status},
+									Status: quotaStatus(map[string]interface{}{"location":status, "cluster":vol.Cluster, "index":d.index.status(vol.Cluster, now)}, vol.Quota),
 								})
-		mountpoint = ""
 	}
 
 	status = "ceph+local"
-	for _, vol := range d.volumes {
+	for _, vol := range local {
 		if(vols.ByName(vol.Name) == nil) {
 			status = "local"
 			if(lib.IsDirectory(vol.Filesystem.Path)) {
@@ -233,7 +720,7 @@ func( d *cephFSDriver ) List() (*volume.ListResponse, error) {
 			vvols = append(vvols, &volume.Volume{
 										Name: vol.Name,
 										Mountpoint: mountpoint,
-										Status: map[string]interface{}{"location":status},
+										Status: quotaStatus(map[string]interface{}{"location":status, "cluster":vol.Cluster, "index":d.index.status(vol.Cluster, now)}, configuredQuota(vol)),
 									})
 			mountpoint = ""
 		} else {
@@ -245,7 +732,7 @@ func( d *cephFSDriver ) List() (*volume.ListResponse, error) {
 			vvols = append(vvols, &volume.Volume{
 				Name: vol.Name,
 				Mountpoint: mountpoint,
-				Status: map[string]interface{}{"location":status},
+				Status: quotaStatus(map[string]interface{}{"location":status, "cluster":vol.Cluster, "index":d.index.status(vol.Cluster, now)}, vols.ByName(vol.Name).Quota),
 			})
 			mountpoint = ""
 		}
@@ -265,9 +752,12 @@ func( d *cephFSDriver ) Get( r *volume.GetRequest ) (*volume.GetResponse, error)
 	logrus.Info("Get Called ", r.Name)
 	defer logrus.Info("Get End")
 
+	unlock := d.locks.Lock(r.Name)
+	defer unlock()
+
 	// Get volume by name
 	logrus.Info("Getting volume by name ...")
-	vol := d.volumes.ByName(r.Name)
+	vol := d.volume(r.Name)
 	if(vol == nil) {
 		err := errors.New(lib.UNABLE_FIND_VOLUME+r.Name)
 		logrus.Error(err.Error())
@@ -275,36 +765,382 @@ func( d *cephFSDriver ) Get( r *volume.GetRequest ) (*volume.GetResponse, error)
 	}
 
 	///logrus.Info("Mounting volume ... "+ vol.Filesystem.Path)
-	///err := vol.Mount(d.monitor, d.user, d.secretfile)
+	///err := vol.Mount(ctx, d.runner, cluster)
 	///if(err != nil) {
 	///	logrus.Error(err.Error())
 	///	return nil, err
 	///}
 
+	ctx, cancel := d.newContext()
+	defer cancel()
+
+	// Read the current usage and the snapshots
+	quota, snaps, err := d.volumeStatus(ctx, *vol)
+	if(err != nil) {
+		logrus.Warn(err.Error())
+	}
+
+	status := quotaStatus(make(map[string]interface{}), quota)
+	status["snapshots"] = snapshotStatus(snaps)
+	if clone := d.clones.status(r.Name); clone != nil {
+		status["clone"] = *clone
+	}
+	status["health"] = d.health.status(r.Name, d.mountCount(r.Name) > 0)
+	status["mount"] = d.mountStatus(*vol)
+
 	return &volume.GetResponse{Volume: &volume.Volume{
 		Name:       vol.Name,
 		Mountpoint: vol.Filesystem.Path,
-		Status:     make(map[string]interface{}),
+		Status:     status,
 	}}, nil
 }
 
+// createDirectory creates the directory of a new volume and sets its quota,
+// the filesystem root is mounted apart from the mountpoint of the volume.
+// It reports whether the directory didn't exist before.
+func (d *cephFSDriver) createDirectory(ctx context.Context, vol lib.Volume) (bool, error) {
+	created := false
+	logrus.Info("Mounting filesystem ...")
+	err := d.withRootMount(ctx, vol, func(root string) error {
+		logrus.Info("Checking volume ...")
+		// Check if volume already exists
+		// Create new volume if it doesn't exist
+		dir := path.Join(root, vol.Subpath)
+		if(!lib.IsDirectory(dir)) {
+			logrus.Info("Creating new volume ...")
+			err := os.MkdirAll(dir, os.ModePerm)
+			if(err != nil) {
+				return errors.New(lib.UNABLE_CREATE_DIR+err.Error())
+			}
+			created = true
+		}
+
+		// Apply quota while the filesystem root is mounted
+		if(vol.Quota.MaxBytes > 0 || vol.Quota.MaxFiles > 0) {
+			logrus.Info("Setting quota ...")
+			return lib.SetQuota(dir, vol.Quota.MaxBytes, vol.Quota.MaxFiles)
+		}
+		return nil
+	})
+	return created, err
+}
+
+// rollbackCreate removes the directory or subvolume created for a volume
+// whose creation failed afterwards.
+func (d *cephFSDriver) rollbackCreate(ctx context.Context, cluster lib.Cluster, vol lib.Volume) {
+	logrus.Info("Rolling back volume ...")
+	var err error
+	if(len(vol.SubvolumeGroup) > 0) {
+		err = lib.RemoveSubvolume(ctx, d.runner, cluster, vol.Filesystem.Name, vol.SubvolumeGroup, vol.Name)
+	} else {
+		err = d.withRootMount(ctx, vol, func(root string) error {
+			return os.RemoveAll(path.Join(root, vol.Subpath))
+		})
+	}
+	if(err != nil) {
+		logrus.Error(err.Error())
+	}
+}
+
+// authorized reports whether the volume has its own ceph client.
+func authorized(vol lib.Volume) bool {
+	val, _ := strconv.ParseBool(vol.Options["authorize"])
+	return val
+}
+
+// authorizeClient creates a ceph client which may only access the subpath of
+// the volume and makes the volume mount with its key.
+func (d *cephFSDriver) authorizeClient(ctx context.Context, cluster lib.Cluster, vol *lib.Volume) error {
+	id := lib.ClientID(vol.Name)
+
+	// fs authorize on an existing client would extend its caps
+	if(vol.Client != id) {
+		exists, err := cluster.ClientExists(ctx, d.runner, id)
+		if(err != nil) {
+			return err
+		} else if(exists) {
+			return errors.New(lib.CLIENT_EXISTS+"client."+id)
+		}
+	}
+
+	keyring, err := cluster.AuthorizeClient(ctx, d.runner, vol.Filesystem.Name, id, vol.Subpath)
+	if(err != nil) {
+		return err
+	}
+
+	file := d.keyringFile(vol.Name)
+	err = lib.WriteKeyring(file, keyring)
+	if(err != nil) {
+		cluster.RevokeClient(ctx, d.runner, id)
+		return err
+	}
+
+	delete(vol.Options, "secretfile")
+	delete(vol.Options, "secret")
+	vol.Options["user"] = id
+	vol.Options["keyring"] = file
+	vol.Client = id
+	return nil
+}
+
+// revokeClient removes the ceph client created for a volume and its
+// keyring. Clients the plugin didn't record are left alone.
+func (d *cephFSDriver) revokeClient(ctx context.Context, vol lib.Volume) error {
+	if(len(vol.Client) == 0) {
+		return nil
+	}
+
+	cluster, err := d.cluster(vol)
+	if(err != nil) {
+		return err
+	}
+	err = cluster.RevokeClient(ctx, d.runner, vol.Client)
+	if(err != nil) {
+		return err
+	}
+
+	os.Remove(d.keyringFile(vol.Name))
+	return nil
+}
+
+func (d *cephFSDriver) keyringFile(name string) string {
+	return path.Join(d.defaultPath, "keys", lib.ClientID(name)+".keyring")
+}
+
+func hasCredentialOptions(options map[string]string) bool {
+	for _, name := range []string{"user", "keyring", "secretfile", "secret"} {
+		if _, ok := options[name]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// configuredQuota returns the quota given in the volume options.
+func configuredQuota(vol lib.Volume) lib.Quota {
+	quota := lib.Quota{}
+	if val, ok := vol.Options["quota_bytes"]; ok {
+		quota.MaxBytes, _ = lib.ParseQuota(val)
+	}
+	if val, ok := vol.Options["quota_files"]; ok {
+		quota.MaxFiles, _ = lib.ParseQuota(val)
+	}
+	return quota
+}
+
+// volumeStatus reads the quota, usage and snapshots of a volume. Subvolumes
+// are asked from ceph, directories are read from a mount.
+func (d *cephFSDriver) volumeStatus(ctx context.Context, vol lib.Volume) (lib.Quota, []lib.Snapshot, error) {
+	quota := configuredQuota(vol)
+	var snaps []lib.Snapshot
+
+	if(len(vol.SubvolumeGroup) > 0) {
+		// Ceph creates the subvolume of a clone, it is only asked once complete
+		if(!d.cloneComplete(vol.Name)) {
+			return quota, nil, nil
+		}
+		cluster, err := d.cluster(vol)
+		if(err != nil) {
+			return quota, nil, err
+		}
+		sub, err := lib.GetSubvolume(ctx, d.runner, cluster, vol.Filesystem.Name, vol.SubvolumeGroup, vol.Name)
+		if(err != nil) {
+			return quota, nil, err
+		} else if(sub == nil) {
+			return quota, nil, errors.New(lib.UNABLE_FIND_VOLUME+vol.Name)
+		}
+		quota.MaxBytes = sub.Quota.MaxBytes
+		quota.Bytes = sub.Quota.Bytes
+		snaps, err = lib.ListSubvolumeSnapshots(ctx, d.runner, cluster, vol.Filesystem.Name, vol.SubvolumeGroup, vol.Name)
+		return quota, snaps, err
+	}
+
+	err := d.withVolumeDir(ctx, vol, func(dir string) error {
+		usage, err := lib.GetQuota(dir)
+		if(err != nil) {
+			logrus.Warn(err.Error())
+		} else {
+			quota = usage
+		}
+		snaps, err = lib.ListSnapshots(dir, "/")
+		return err
+	})
+	return quota, snaps, err
+}
+
+// mountStatus describes what is really mounted on the mountpoint of a volume
+// and which containers use it.
+func (d *cephFSDriver) mountStatus(vol lib.Volume) map[string]interface{} {
+	status := map[string]interface{}{
+		"mounted":   false,
+		"mount_ids": d.mountIDs(vol.Name),
+	}
+
+	state, err := d.inspector.Inspect(vol.Filesystem.Path)
+	if(err != nil) {
+		logrus.Warn(err.Error())
+		return status
+	}
+	status["mounted"] = state.Mounted
+	if(state.Mounted || state.Stale) {
+		status["type"] = state.Type
+		status["source"] = state.Source
+		status["root"] = state.Root
+		status["stale"] = state.Stale
+	}
+	return status
+}
+
+// quotaStatus adds the quota and usage of a volume to its status.
+func quotaStatus(status map[string]interface{}, quota lib.Quota) map[string]interface{} {
+	status["quota_bytes"] = quota.MaxBytes
+	status["quota_files"] = quota.MaxFiles
+	status["used_bytes"] = quota.Bytes
+	status["used_files"] = quota.Files
+	return status
+}
+
 func( d *cephFSDriver ) Remove( r *volume.RemoveRequest ) error {
 	logrus.Info("Remove Called ", r.Name)
 	defer logrus.Info("Remove End")
 
-	//TODO: Update ceph volumes
+	unlock := d.locks.Lock(r.Name)
+	defer unlock()
+
+	ctx, cancel := d.newContext()
+	defer cancel()
+
+	local := d.volume(r.Name)
+	if(local != nil && d.takeAdopted(r.Name)) {
+		// Mounted before a restart but not used by a container since
+		logrus.Info("Unmounting volume of the previous run ...")
+		err := local.Unmount(ctx, d.runner)
+		if(err != nil) {
+			logrus.Error(err.Error())
+			return err
+		}
+	}
+
+	// Refuse to remove a volume that is still in use
+	if(d.mountCount(r.Name) > 0 || (local != nil && lib.IsMountpoint(local.Filesystem.Path))) {
+		err := errors.New(lib.VOLUME_IN_USE+r.Name)
+		logrus.Error(err.Error())
+		return err
+	}
+	if(d.clones.isSource(r.Name)) {
+		err := errors.New(lib.CLONE_SOURCE_IN_USE+r.Name)
+		logrus.Error(err.Error())
+		return err
+	}
+	// A running clone into the volume is stopped, its status is only
+	// forgotten with the volume
+	d.clones.stop(r.Name)
 
-	//TODO: Get ceph volume by name
+	// Subvolumes are removed by ceph
+	if(local != nil && len(local.SubvolumeGroup) > 0) {
+		err := d.removeSubvolume(ctx, *local)
+		if(err != nil) {
+			logrus.Error(err.Error())
+			return err
+		}
+		d.removeVolume(r.Name)
+		d.saveState()
+		os.Remove(local.Filesystem.Path)
+		return nil
+	}
 
-	//TODO: Mount filesystem
+	// Search the cluster of a known volume, otherwise all clusters
+	clusters := d.clusterList()
+	if(local != nil) {
+		cluster, err := d.cluster(*local)
+		if(err != nil) {
+			logrus.Error(err.Error())
+			return err
+		}
+		clusters = []lib.Cluster{cluster}
+	}
+
+	// Get ceph volume by name
+	logrus.Info("Getting volume by name ...")
+	var vol *lib.Volume
+	for _, cluster := range clusters {
+		// Listed through the shared management mounts
+		vols, err := d.indexClusterVolumes(ctx, cluster)
+		if(err != nil) {
+			logrus.Error(err.Error())
+			return err
+		}
+		if vol = vols.ByName(r.Name); vol != nil {
+			break
+		}
+	}
+	if(vol == nil) {
+		if(local == nil) {
+			err := errors.New(lib.UNABLE_FIND_VOLUME+r.Name)
+			logrus.Error(err.Error())
+			return err
+		}
+		// Volume only known locally, nothing to delete in ceph
+		err := d.revokeClient(ctx, *local)
+		if(err != nil) {
+			logrus.Error(err.Error())
+			return err
+		}
+		d.removeVolume(r.Name)
+		d.saveState()
+		return nil
+	}
 
-	//TODO: Delete volume directory
+	if(len(vol.SubvolumeGroup) > 0) {
+		// Subvolume only known in ceph
+		err := d.removeSubvolume(ctx, *vol)
+		if(err != nil) {
+			logrus.Error(err.Error())
+			return err
+		}
+		d.index.remove(r.Name)
+		return nil
+	}
 
-	//TODO: Remove volume from array
+	subpath := vol.Subpath
+	if(local != nil) {
+		subpath = local.Subpath
+	}
+	if(path.Clean("/"+subpath) == "/") {
+		err := errors.New(lib.REMOVE_ROOT_ERROR+r.Name)
+		logrus.Error(err.Error())
+		return err
+	}
 
-	//TODO: Unmount filesystem
+	// The filesystem root is mounted on a directory of its own, parallel
+	// removes of other volumes don't share it
+	logrus.Info("Deleting volume directory ...")
+	err := d.withRootMount(ctx, *vol, func(root string) error {
+		err := os.RemoveAll(path.Join(root, subpath))
+		if(err != nil) {
+			return errors.New(lib.UNABLE_REMOVE_DIR+err.Error())
+		}
 
-	return errors.New("error Remove NIJ")
+		// Revoke the ceph client of the volume once its data is gone
+		if(local != nil) {
+			return d.revokeClient(ctx, *local)
+		}
+		return nil
+	})
+	if(err != nil) {
+		logrus.Error(err.Error())
+		return err
+	}
+
+	// Remove volume from array
+	d.removeVolume(r.Name)
+	d.saveState()
+	if(local != nil) {
+		// Drop the now unused local mount directory
+		os.Remove(local.Filesystem.Path)
+	}
+
+	return nil
 }
 
 func( d *cephFSDriver ) Path( r *volume.PathRequest ) (*volume.PathResponse, error) {
@@ -313,24 +1149,27 @@ func( d *cephFSDriver ) Path( r *volume.PathRequest ) (*volume.PathResponse, err
 
 	// Get volume by name
 	logrus.Info("Getting volume by name ...")
-	vol := d.volumes.ByName(r.Name)
+	vol := d.volume(r.Name)
 	if(vol == nil) {
 		err := errors.New(lib.UNABLE_FIND_VOLUME+r.Name)
 		logrus.Error(err.Error())
 		return nil, err
 	}
 
-	mountpoint := ""
-	if(lib.IsDirectory(vol.Filesystem.Path)) {
-		mountpoint = vol.Filesystem.Path
-	} else {
+	// An empty directory isn't a mounted volume
+	state, err := d.inspector.Inspect(vol.Filesystem.Path)
+	if(err != nil) {
+		logrus.Error(err.Error())
+		return nil, err
+	}
+	if(!state.Mounted) {
 		err := errors.New(lib.VOLUME_NOT_MOUNTED+r.Name)
 		logrus.Error(err.Error())
 		return nil, err
 	}
-	
+
 	return &volume.PathResponse{
-		Mountpoint: mountpoint,
+		Mountpoint: vol.Filesystem.Path,
 	}, nil
 }
 
@@ -339,23 +1178,66 @@ func (d *cephFSDriver ) Mount( r *volume.MountRequest ) (*volume.MountResponse,
 	logrus.Info("Mount Called ",r.ID," ", r.Name)
 	defer logrus.Info("Mount End")
 
+	unlock := d.locks.Lock(r.Name)
+	defer unlock()
+
+	ctx, cancel := d.newContext()
+	defer cancel()
+
 	// Get volume by name
 	logrus.Info("Getting volume by name ...")
-	vol := d.volumes.ByName(r.Name)
+	vol := d.volume(r.Name)
 	if(vol == nil) {
 		err := errors.New(lib.UNABLE_FIND_VOLUME+r.Name)
 		logrus.Error(err.Error())
 		return nil, err
 	}
 
-	logrus.Info("Mounting ceph volume ...")
-	// Mount volume
-	err := vol.Mount(d.monitor, d.user, d.secretfile)
-	if(err != nil) {
+	// A clone must be complete before the volume is used
+	if(!d.cloneComplete(r.Name)) {
+		err := errors.New(lib.CLONE_NOT_COMPLETE+r.Name)
 		logrus.Error(err.Error())
 		return nil, err
 	}
 
+	// Only the first container actually mounts the volume
+	count := d.mountCount(r.Name)
+	if(count == 0 && d.takeAdopted(r.Name)) {
+		logrus.Info("Using the volume mount of the previous run")
+	} else if(count == 0) {
+		resolved, err := d.subvolumePath(ctx, *vol)
+		if(err != nil) {
+			logrus.Error(err.Error())
+			return nil, err
+		}
+		vol = &resolved
+
+		cluster, err := d.mountCluster(*vol)
+		if(err != nil) {
+			logrus.Error(err.Error())
+			return nil, err
+		}
+
+		err = os.MkdirAll(vol.Filesystem.Path, os.ModePerm)
+		if(err != nil) {
+			err = errors.New(lib.UNABLE_CREATE_DIR+err.Error())
+			logrus.Error(err.Error())
+			return nil, err
+		}
+
+		logrus.Info("Mounting ceph volume ...")
+		// Mount volume
+		err = vol.Mount(ctx, d.runner, cluster)
+		if(err != nil) {
+			logrus.Error(err.Error())
+			return nil, err
+		}
+	} else {
+		logrus.Info("Volume already mounted, ", count, " active mount(s)")
+	}
+	d.addMount(r.Name, r.ID)
+	d.saveState()
+
 	return &volume.MountResponse{ Mountpoint: vol.Filesystem.Path}, nil
 }
 
@@ -363,22 +1245,57 @@ func (d *cephFSDriver ) Unmount( r *volume.UnmountRequest ) error {
 	logrus.Info("Unmount Called ", r.ID, " ", r.Name)
 	defer logrus.Info("Unmount End")
 
+	unlock := d.locks.Lock(r.Name)
+	defer unlock()
+
+	ctx, cancel := d.newContext()
+	defer cancel()
+
 	// Get volume by name
 	logrus.Info("Getting volume by name ...")
-	vol := d.volumes.ByName(r.Name)
+	vol := d.volume(r.Name)
 	if(vol == nil) {
 		err := errors.New(lib.UNABLE_FIND_VOLUME+r.Name)
 		logrus.Error(err.Error())
 		return err
 	}
 
+	known, count := d.releaseMount(r.Name, r.ID)
+	if(!known) {
+		logrus.Warn("Unknown mount ID ", r.ID, " for volume ", r.Name)
+		return nil
+	}
+
+	// Only the last container actually unmounts the volume
+	if(count > 0) {
+		logrus.Info("Volume still in use, ", count, " active mount(s)")
+		d.saveState()
+		return nil
+	}
+
 	logrus.Info("Unmount volume ...")
-	// Unmount volume
-	err := vol.Unmount()
+	// Unmount volume, after a failed remount at most a dead mount is left
+	var err error
+	if(d.health.unhealthy(r.Name)) {
+		_, err = d.runner.Run(ctx, "umount", "-l", vol.Filesystem.Path)
+		if(err != nil) {
+			err = errors.New(lib.UNABLE_UNMOUNT+err.Error())
+		}
+	} else {
+		err = vol.Unmount(ctx, d.runner)
+	}
+	if(err != nil && strings.Contains(err.Error(), "not mounted")) {
+		logrus.Warn(err.Error())
+		err = nil
+	}
 	if (err != nil) {
+		// Keep the mount ID so the unmount can be retried
+		d.addMount(r.Name, r.ID)
 		logrus.Error(err.Error())
 		return err
 	}
+	d.health.remove(r.Name)
+	d.saveState()
 
 	return nil
 }
@@ -1,14 +1,1177 @@
 package main
 
 import (
+	lib "./lib"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/go-plugins-helpers/volume"
 	"github.com/stretchr/testify/assert"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
+)
+
+const (
+	fakeFsLs = `[{"name":"cephfs","metadata_pool":"cephfs_metadata","metadata_pool_id":2,"data_pool_ids":[1],"data_pools":["cephfs_data"]}]`
+	fakeFsDump = `{"epoch":5,"filesystems":[{"mdsmap":{"fs_name":"cephfs","data_pools":[1],"metadata_pool":2},"id":1}]}`
 )
 
+/**
+Test helpers
+*/
+func testConfig(dir string) Config {
+	config := DefaultConfiguration()
+	config.Path = dir
+	config.Monitors = []string{"mon1"}
+	config.Auth.SecretFile = "/etc/ceph/admin.secret"
+	return config
+}
+
+func newTestDriver(t *testing.T) (*cephFSDriver, *lib.FakeRunner) {
+	logrus.SetOutput(ioutil.Discard)
+
+	runner := lib.NewFakeRunner()
+	runner.On("ceph fs ls", fakeFsLs, nil)
+	runner.On("ceph fs dump", fakeFsDump, nil)
+	runner.OnFunc("ls -1", func(name string, args ...string) (string, error) {
+		var names []string
+		infos, _ := ioutil.ReadDir(args[1])
+		for _, info := range infos {
+			names = append(names, info.Name())
+		}
+		return strings.Join(names, "\n"), nil
+	})
+
+	dir, err := ioutil.TempDir("", "cephfs-driver")
+	if(err != nil) {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	d, err := newCephFSDriver(runner, testConfig(dir))
+	if(err != nil) {
+		t.Fatal(err)
+	}
+	runner.Reset()
+
+	return &d, runner
+}
+
 /**
 Test functions
 */
 func TestIsDirectory(t *testing.T) {
-	assert.True(t, IsDirectory("."))
-	assert.False(t, IsDirectory("/dont/exists"))
+	assert.True(t, lib.IsDirectory("."))
+	assert.False(t, lib.IsDirectory("/dont/exists"))
+}
+
+func TestCreate(t *testing.T) {
+	tests := []struct {
+		name	string
+		options	map[string]string
+		err		string
+	}{
+		{"missing fsname", map[string]string{}, lib.REQUIRED_OPTIONS},
+		{"invalid mount type", map[string]string{"fsname": "cephfs", "mounttype": "nfs"}, lib.INVALID_MOUNT_TYPE+"nfs"},
+		{"invalid quota", map[string]string{"fsname": "cephfs", "quota_bytes": "1G"}, lib.INVALID_QUOTA+"1G"},
+		{"new filesystem without pools", map[string]string{"fsname": "other"}, lib.MISSING_POOL_OPTION},
+		{"subpath escaping the filesystem", map[string]string{"fsname": "cephfs", "subpath": "team/../../etc"}, lib.INVALID_SUBPATH+"team/../../etc"},
+		{"nested subpath", map[string]string{"fsname": "cephfs", "subpath": "staging/dataio/fileStore"}, ""},
+		{"unknown cluster", map[string]string{"fsname": "cephfs", "cluster": "other"}, lib.UNKNOWN_CLUSTER+"other"},
+		{"existing filesystem", map[string]string{"fsname": "cephfs"}, ""},
+		{"kernel mount", map[string]string{"fsname": "cephfs", "mounttype": "kernel"}, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d, runner := newTestDriver(t)
+
+			err := d.Create(&volume.CreateRequest{Name: "vol", Options: test.options})
+
+			if(len(test.err) > 0) {
+				assert.EqualError(t, err, test.err)
+				assert.Nil(t, d.volumes.ByName("vol"))
+				return
+			}
+			assert.Nil(t, err)
+			assert.NotNil(t, d.volumes.ByName("vol"))
+			assert.Len(t, runner.CallsWithPrefix("mount"), 1)
+			assert.Len(t, runner.CallsWithPrefix("umount"), 1)
+
+			// The volume survives a restart through the state file
+			restored, err := newCephFSDriver(runner, testConfig(d.defaultPath))
+			assert.Nil(t, err)
+			assert.Equal(t, test.options["mounttype"], restored.volumes.ByName("vol").Options["mounttype"])
+		})
+	}
+}
+
+func TestList(t *testing.T) {
+	d, _ := newTestDriver(t)
+	assert.Nil(t, d.Create(&volume.CreateRequest{Name: "vol", Options: map[string]string{"fsname": "cephfs"}}))
+
+	res, err := d.List()
+
+	assert.Nil(t, err)
+	var names []string
+	for _, vol := range res.Volumes {
+		names = append(names, vol.Name)
+	}
+	assert.Contains(t, names, "vol")
+}
+
+func TestListClusters(t *testing.T) {
+	d, runner := newTestDriver(t)
+	config := testConfig(d.defaultPath)
+	config.Clusters = map[string]ClusterConfig{
+		"prod":    {Monitors: []string{"prod-mon"}, Filesystem: "cephfs"},
+		"staging": {Monitors: []string{"staging-mon"}, Filesystem: "cephfs"},
+	}
+	config.DefaultCluster = "prod"
+	multi, err := newCephFSDriver(runner, config)
+	assert.Nil(t, err)
+
+	assert.Nil(t, multi.Create(&volume.CreateRequest{Name: "vol", Options: map[string]string{"cluster": "staging"}}))
+	assert.Equal(t, "staging", multi.volumes.ByName("vol").Cluster)
+	assert.Contains(t, runner.CallsWithPrefix("mount")[len(runner.CallsWithPrefix("mount"))-1], "staging-mon:/")
+
+	runner.Reset()
+	assert.Nil(t, multi.refreshIndex(context.Background()))
+	assert.NotEmpty(t, runner.CallsWithPrefix("ceph --mon-host prod-mon"))
+	assert.NotEmpty(t, runner.CallsWithPrefix("ceph --mon-host staging-mon"))
+
+	res, err := multi.List()
+	assert.Nil(t, err)
+	for _, vol := range res.Volumes {
+		if(vol.Name == "vol") {
+			assert.Equal(t, "staging", vol.Status["cluster"])
+		}
+	}
+}
+
+func TestVolumeIndex(t *testing.T) {
+	base, runner := newTestDriver(t)
+	cephRoot := fakeCephRoot(t, runner)
+	d, err := newCephFSDriver(runner, testConfig(base.defaultPath))
+	assert.Nil(t, err)
+
+	mounts := newFakeStatfs()
+	d.inspector.Statfs = mounts.statfs
+	manage := path.Join(d.defaultPath, managementDir, "default", "cephfs")
+
+	// List is served from the index without mounting
+	assert.Nil(t, d.Create(&volume.CreateRequest{Name: "vol", Options: map[string]string{"fsname": "cephfs"}}))
+	runner.Reset()
+	mounts.reset()
+	res, err := d.List()
+	assert.Nil(t, err)
+	assert.Len(t, res.Volumes, 1)
+	assert.Empty(t, runner.Calls())
+	index := res.Volumes[0].Status["index"].(map[string]interface{})
+	assert.Equal(t, false, index["stale"])
+
+	// A refresh finds new directories and keeps the management mount
+	assert.Nil(t, os.Mkdir(path.Join(cephRoot, "other"), os.ModePerm))
+	assert.Nil(t, d.refreshIndex(context.Background()))
+	assert.Nil(t, d.refreshIndex(context.Background()))
+	assert.Empty(t, runner.CallsWithPrefix("mount"))
+	assert.Equal(t, 2, mounts.calls(manage))
+	res, err = d.List()
+	assert.Nil(t, err)
+	assert.Len(t, res.Volumes, 2)
+
+	// An unresponsive management mount is mounted again
+	mounts.kill(manage)
+	runner.Reset()
+	assert.Nil(t, d.refreshIndex(context.Background()))
+	assert.Len(t, runner.CallsWithPrefix("umount -l"), 1)
+	assert.Len(t, runner.CallsWithPrefix("mount -t"), 1)
+
+	// A failed refresh keeps the volumes but marks the index stale
+	runner.On("ceph fs ls", "", errors.New("timeout"))
+	assert.NotNil(t, d.refreshIndex(context.Background()))
+	res, err = d.List()
+	assert.Nil(t, err)
+	assert.Len(t, res.Volumes, 2)
+	index = res.Volumes[0].Status["index"].(map[string]interface{})
+	assert.Equal(t, true, index["stale"])
+	assert.Contains(t, index["error"], "timeout")
+}
+
+func TestMountTree(t *testing.T) {
+	d, runner := newTestDriver(t)
+	assert.Nil(t, d.Create(&volume.CreateRequest{Name: "vol", Options: map[string]string{"fsname": "cephfs"}}))
+	mountpoint := path.Join(d.defaultPath, "mounts", "vol")
+	assert.Equal(t, mountpoint, d.volumes.ByName("vol").Filesystem.Path)
+	// The filesystem root is never mounted on the mountpoint of a volume
+	for _, call := range runner.CallsWithPrefix("mount") {
+		assert.NotContains(t, call, " "+mountpoint+" ")
+	}
+
+	runner.Reset()
+	res, err := d.Mount(&volume.MountRequest{Name: "vol", ID: "c1"})
+	assert.Nil(t, err)
+	assert.Equal(t, mountpoint, res.Mountpoint)
+	assert.Len(t, runner.CallsWithPrefix("mount -t ceph-fuse mon1:/vol "+mountpoint+" "), 1)
+	fakeMountTable(t, d, mountpoint)
+	pres, err := d.Path(&volume.PathRequest{Name: "vol"})
+	assert.Nil(t, err)
+	assert.Equal(t, mountpoint, pres.Mountpoint)
+
+	// Volumes of older versions move to the mount tree once unmounted
+	state := lib.State{Volumes: []lib.VolumeState{
+		{Volume: lib.Volume{Name: "old", Subpath: "/old", Filesystem: lib.Filesystem{Name: "cephfs", Path: path.Join(d.defaultPath, "old")}}},
+	}}
+	assert.Nil(t, state.Save(d.stateFile))
+	restored, err := newCephFSDriver(runner, testConfig(d.defaultPath))
+	assert.Nil(t, err)
+	assert.Equal(t, path.Join(d.defaultPath, "mounts", "old"), restored.volumes.ByName("old").Filesystem.Path)
+}
+
+func TestReconcileMounts(t *testing.T) {
+	d, runner := newTestDriver(t)
+	for _, name := range []string{"live", "dead"} {
+		assert.Nil(t, d.Create(&volume.CreateRequest{Name: name, Options: map[string]string{"fsname": "cephfs"}}))
+	}
+	// Mountpoints outside of the mount tree are given with the path option
+	custom := path.Join(d.defaultPath, "custom")
+	other := path.Join(d.defaultPath, "..", path.Base(d.defaultPath)+"-other")
+	defer os.RemoveAll(other)
+	assert.Nil(t, d.Create(&volume.CreateRequest{Name: "custom", Options: map[string]string{"fsname": "cephfs", "path": custom}}))
+	assert.Nil(t, d.Create(&volume.CreateRequest{Name: "other", Options: map[string]string{"fsname": "cephfs", "path": other}}))
+
+	// Mounts left behind by a crashed plugin
+	mountinfo := ""
+	for i, mountpoint := range []string{
+		d.mountpoint("live"),
+		d.mountpoint("live"),
+		d.mountpoint("dead"),
+		d.mountpoint("unknown"),
+		custom,
+		path.Clean(other),
+		path.Join(d.defaultPath, managementDir, "default", "cephfs"),
+		path.Join(d.defaultPath, "root-123"),
+	} {
+		mountinfo += fmt.Sprintf("%d 22 0:%d / %s rw,relatime shared:1 - fuse.ceph-fuse ceph-fuse rw\n", 100+i, 50+i, mountpoint)
+	}
+	mountinfo += "110 22 0:60 / /mnt/other rw - ceph mon1:/ rw\n"
+	file := path.Join(d.defaultPath, "mountinfo")
+	assert.Nil(t, ioutil.WriteFile(file, []byte(mountinfo), 0600))
+	defer func(orig string) { mountInfoFile = orig }(mountInfoFile)
+	mountInfoFile = file
+	defer func(orig func(string, *syscall.Statfs_t) error) { statfs = orig }(statfs)
+	statfs = newFakeStatfs(d.mountpoint("dead")).statfs
+
+	runner.Reset()
+	restored, err := newCephFSDriver(runner, testConfig(d.defaultPath))
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{
+		"umount -l "+d.mountpoint("live"),
+		"umount -l "+d.mountpoint("dead"),
+		"umount -l "+d.mountpoint("unknown"),
+		"umount -l "+path.Join(d.defaultPath, "root-123"),
+	}, runner.CallsWithPrefix("umount"))
+	// The adopted management mount is used for the index
+	assert.Empty(t, runner.CallsWithPrefix("mount"))
+
+	// The first container uses the adopted mount
+	runner.Reset()
+	res, err := restored.Mount(&volume.MountRequest{Name: "live", ID: "c1"})
+	assert.Nil(t, err)
+	assert.Equal(t, d.mountpoint("live"), res.Mountpoint)
+	for _, name := range []string{"custom", "other"} {
+		_, err = restored.Mount(&volume.MountRequest{Name: name, ID: "c1"})
+		assert.Nil(t, err)
+	}
+	assert.Empty(t, runner.CallsWithPrefix("mount"))
+	_, err = restored.Mount(&volume.MountRequest{Name: "dead", ID: "c1"})
+	assert.Nil(t, err)
+	assert.Len(t, runner.CallsWithPrefix("mount -t ceph-fuse mon1:/dead "), 1)
+}
+
+func TestHealthMonitor(t *testing.T) {
+	d, runner := newTestDriver(t)
+	assert.Nil(t, d.Create(&volume.CreateRequest{Name: "vol", Options: map[string]string{"fsname": "cephfs"}}))
+	assert.Nil(t, d.Create(&volume.CreateRequest{Name: "idle", Options: map[string]string{"fsname": "cephfs"}}))
+	_, err := d.Mount(&volume.MountRequest{Name: "vol", ID: "c1"})
+	assert.Nil(t, err)
+	health := func(name string) map[string]interface{} {
+		res, err := d.Get(&volume.GetRequest{Name: name})
+		assert.Nil(t, err)
+		return res.Volume.Status["health"].(map[string]interface{})
+	}
+
+	// Mounts are checked without running any command
+	mounts := newFakeStatfs()
+	d.inspector.Statfs = mounts.statfs
+	runner.On("stat", "", &exec.Error{Name: "stat", Err: exec.ErrNotFound})
+	runner.Reset()
+	d.checkMounts()
+	assert.Equal(t, []string{d.mountpoint("vol")}, mounts.reset())
+	assert.Empty(t, runner.Calls())
+	assert.Equal(t, mountHealthy, health("vol")["state"])
+	assert.Equal(t, mountUnmounted, health("idle")["state"])
+
+	// A disconnected mount is replaced
+	mounts.kill(d.mountpoint("vol"))
+	runner.Reset()
+	d.checkMounts()
+	assert.Equal(t, []string{"umount -l "+d.mountpoint("vol")}, runner.CallsWithPrefix("umount"))
+	assert.Len(t, runner.CallsWithPrefix("mount -t ceph-fuse mon1:/vol "+d.mountpoint("vol")), 1)
+	status := health("vol")
+	assert.Equal(t, mountHealthy, status["state"])
+	assert.Equal(t, 1, status["remounts"])
+	assert.NotEmpty(t, status["last_failure"])
+	assert.Contains(t, status["error"], syscall.ENOTCONN.Error())
+
+	// and stays unhealthy if ceph can't be reached
+	runner.On("mount -t ceph-fuse mon1:/vol", "", errors.New("connection timed out"))
+	d.checkMounts()
+	status = health("vol")
+	assert.Equal(t, mountUnhealthy, status["state"])
+	assert.Contains(t, status["error"], "connection timed out")
+
+	// The mount is retried until it succeeds
+	runner.On("mount -t ceph-fuse mon1:/vol", "", nil)
+	runner.Reset()
+	mounts.reset()
+	d.checkMounts()
+	assert.Empty(t, mounts.reset())
+	assert.Empty(t, runner.CallsWithPrefix("umount"))
+	assert.Len(t, runner.CallsWithPrefix("mount -t ceph-fuse mon1:/vol"), 1)
+	assert.Equal(t, mountHealthy, health("vol")["state"])
+
+	// A container stopping while nothing is mounted after a failed remount
+	// releases the volume
+	runner.On("mount -t ceph-fuse mon1:/vol", "", errors.New("connection timed out"))
+	d.checkMounts()
+	assert.Equal(t, mountUnhealthy, health("vol")["state"])
+	runner.On("umount", "", &lib.CommandError{Command: "umount", ExitCode: 32, Stderr: "umount: "+d.mountpoint("vol")+": not mounted."})
+	assert.Nil(t, d.Unmount(&volume.UnmountRequest{Name: "vol", ID: "c1"}))
+	assert.Equal(t, 0, d.mountCount("vol"))
+	assert.Equal(t, map[string]interface{}{"state": mountUnmounted}, health("vol"))
+	runner.On("umount", "", nil)
+	assert.Nil(t, d.Remove(&volume.RemoveRequest{Name: "vol"}))
+}
+
+func TestMountState(t *testing.T) {
+	d, _ := newTestDriver(t)
+	assert.Nil(t, d.Create(&volume.CreateRequest{Name: "vol", Options: map[string]string{"fsname": "cephfs"}}))
+	mount := func() map[string]interface{} {
+		res, err := d.Get(&volume.GetRequest{Name: "vol"})
+		assert.Nil(t, err)
+		return res.Volume.Status["mount"].(map[string]interface{})
+	}
+
+	// The empty mountpoint directory isn't a mount
+	fakeMountTable(t, d)
+	assert.True(t, lib.IsDirectory(d.mountpoint("vol")))
+	_, err := d.Path(&volume.PathRequest{Name: "vol"})
+	assert.EqualError(t, err, lib.VOLUME_NOT_MOUNTED+"vol")
+	assert.Equal(t, map[string]interface{}{"mounted": false, "mount_ids": []string{}}, mount())
+
+	for _, id := range []string{"c2", "c1"} {
+		_, err = d.Mount(&volume.MountRequest{Name: "vol", ID: id})
+		assert.Nil(t, err)
+	}
+	fakeMountTable(t, d, d.mountpoint("vol"))
+	res, err := d.Path(&volume.PathRequest{Name: "vol"})
+	assert.Nil(t, err)
+	assert.Equal(t, d.mountpoint("vol"), res.Mountpoint)
+	assert.Equal(t, map[string]interface{}{
+		"mounted":   true,
+		"mount_ids": []string{"c1", "c2"},
+		"type":      lib.MountTypeFuse,
+		"source":    "ceph-fuse",
+		"root":      "/",
+		"stale":     false,
+	}, mount())
+
+	// A hanging mount is reported stale once statfs times out
+	hang := make(chan struct{})
+	defer close(hang)
+	d.inspector.Statfs = lib.TimeoutStatfs(func(file string, buf *syscall.Statfs_t) error {
+		<-hang
+		return nil
+	}, 10*time.Millisecond)
+	status := mount()
+	assert.Equal(t, false, status["mounted"])
+	assert.Equal(t, true, status["stale"])
+	_, err = d.Path(&volume.PathRequest{Name: "vol"})
+	assert.EqualError(t, err, lib.VOLUME_NOT_MOUNTED+"vol")
+}
+
+func TestMountUnmount(t *testing.T) {
+	steps := []struct {
+		op		string
+		id		string
+		mounts	int
+		umounts	int
+	}{
+		{"mount", "c1", 1, 0},
+		{"mount", "c2", 1, 0},
+		{"unmount", "c1", 1, 0},
+		{"unmount", "c2", 1, 1},
+		{"mount", "c3", 2, 1},
+		{"unmount", "c3", 2, 2},
+	}
+
+	d, runner := newTestDriver(t)
+	assert.Nil(t, d.Create(&volume.CreateRequest{Name: "vol", Options: map[string]string{"fsname": "cephfs"}}))
+	runner.Reset()
+
+	for _, step := range steps {
+		if(step.op == "mount") {
+			res, err := d.Mount(&volume.MountRequest{Name: "vol", ID: step.id})
+			assert.Nil(t, err)
+			assert.Equal(t, d.volumes.ByName("vol").Filesystem.Path, res.Mountpoint)
+		} else {
+			assert.Nil(t, d.Unmount(&volume.UnmountRequest{Name: "vol", ID: step.id}))
+		}
+		assert.Len(t, runner.CallsWithPrefix("mount"), step.mounts, step.op+" "+step.id)
+		assert.Len(t, runner.CallsWithPrefix("umount"), step.umounts, step.op+" "+step.id)
+	}
+}
+
+func TestConcurrentRequests(t *testing.T) {
+	base, runner := newTestDriver(t)
+	cephRoot := fakeCephRoot(t, runner)
+	d, err := newCephFSDriver(runner, testConfig(base.defaultPath))
+	assert.Nil(t, err)
+	names := []string{"a", "b", "c", "d"}
+	options := map[string]string{"fsname": "cephfs"}
+
+	var wg sync.WaitGroup
+	parallel := func(fn func(name string, id string)) {
+		for _, name := range names {
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func(name string, id string) {
+					defer wg.Done()
+					fn(name, id)
+				}(name, fmt.Sprint("c", i))
+			}
+		}
+		wg.Wait()
+	}
+
+	parallel(func(name string, id string) {
+		assert.Nil(t, d.Create(&volume.CreateRequest{Name: name, Options: options}))
+	})
+	assert.Len(t, d.volumeList(), len(names))
+	runner.Reset()
+
+	// Each volume is mounted once however many containers start in parallel
+	parallel(func(name string, id string) {
+		res, err := d.Mount(&volume.MountRequest{Name: name, ID: id})
+		assert.Nil(t, err)
+		assert.Equal(t, d.mountpoint(name), res.Mountpoint)
+		_, err = d.List()
+		assert.Nil(t, err)
+		_, err = d.Get(&volume.GetRequest{Name: name})
+		assert.Nil(t, err)
+	})
+	for _, name := range names {
+		assert.Len(t, runner.CallsWithPrefix("mount -t ceph-fuse mon1:/"+name+" "), 1, name)
+		assert.Equal(t, 10, d.mountCount(name), name)
+	}
+
+	// and unmounted once the last container stopped
+	parallel(func(name string, id string) {
+		assert.Nil(t, d.Unmount(&volume.UnmountRequest{Name: name, ID: id}))
+	})
+	for _, name := range names {
+		assert.Len(t, runner.CallsWithPrefix("umount "+d.mountpoint(name)), 1, name)
+		assert.Equal(t, 0, d.mountCount(name), name)
+	}
+
+	// Each volume is removed once, the filesystem roots of parallel
+	// removes don't share a mountpoint
+	var removed sync.Map
+	parallel(func(name string, id string) {
+		err := d.Remove(&volume.RemoveRequest{Name: name})
+		if(err == nil) {
+			_, again := removed.LoadOrStore(name, true)
+			assert.False(t, again, name)
+			return
+		}
+		assert.EqualError(t, err, lib.UNABLE_FIND_VOLUME+name)
+	})
+	assert.Empty(t, d.volumeList())
+	for _, name := range names {
+		_, ok := removed.Load(name)
+		assert.True(t, ok, name)
+		assert.False(t, lib.IsDirectory(path.Join(cephRoot, name)), name)
+	}
+	mountpoints := make(map[string]bool)
+	for _, call := range runner.CallsWithPrefix("mount -t ceph-fuse mon1:/ ") {
+		mountpoint := strings.Fields(call)[4]
+		assert.False(t, mountpoints[mountpoint], mountpoint)
+		mountpoints[mountpoint] = true
+	}
+	assert.Len(t, mountpoints, len(names))
+}
+
+func TestMountCredentials(t *testing.T) {
+	d, runner := newTestDriver(t)
+	keyring := path.Join(d.defaultPath, "team.keyring")
+	assert.Nil(t, ioutil.WriteFile(keyring, []byte("[client.team]\n\tkey = AQTeamKey==\n"), 0600))
+
+	// Insecure or unknown credentials are refused at creation
+	assert.Nil(t, os.Chmod(keyring, 0644))
+	err := d.Create(&volume.CreateRequest{Name: "vol", Options: map[string]string{"fsname": "cephfs", "user": "team", "keyring": keyring}})
+	assert.EqualError(t, err, lib.INSECURE_SECRET_FILE+keyring)
+	assert.Nil(t, os.Chmod(keyring, 0600))
+	err = d.Create(&volume.CreateRequest{Name: "vol", Options: map[string]string{"fsname": "cephfs", "user": "other", "keyring": keyring}})
+	assert.EqualError(t, err, lib.MISSING_KEYRING_ENTRY+"client.other")
+
+	assert.Nil(t, d.Create(&volume.CreateRequest{Name: "vol", Options: map[string]string{"fsname": "cephfs", "mounttype": "kernel", "user": "team", "keyring": keyring}}))
+	runner.Reset()
+	secrets := fakeKernelSecrets(runner)
+
+	_, err = d.Mount(&volume.MountRequest{Name: "vol", ID: "c1"})
+	assert.Nil(t, err)
+	mounts := runner.CallsWithPrefix("mount -t ceph ")
+	assert.Len(t, mounts, 1)
+	assert.Contains(t, mounts[0], "name=team,secretfile=")
+	assert.Contains(t, mounts[0], ",mds_namespace=cephfs")
+	assert.NotContains(t, mounts[0], "AQTeamKey==")
+	assert.Equal(t, []string{"AQTeamKey==\n"}, *secrets)
+
+	res, err := d.Get(&volume.GetRequest{Name: "vol"})
+	assert.Nil(t, err)
+	for _, value := range res.Volume.Status {
+		assert.NotContains(t, fmt.Sprint(value), "AQTeamKey==")
+	}
+}
+
+func TestAuthorizeClient(t *testing.T) {
+	base, runner := newTestDriver(t)
+	cephRoot := fakeCephRoot(t, runner)
+	d, err := newCephFSDriver(runner, testConfig(base.defaultPath))
+	assert.Nil(t, err)
+	runner.On("ceph fs authorize cephfs client.docker.vol /vol rw", "[client.docker.vol]\n\tkey = AQVolKey==", nil)
+
+	assert.Nil(t, d.Create(&volume.CreateRequest{Name: "vol", Options: map[string]string{"fsname": "cephfs", "mounttype": "kernel", "authorize": "true"}}))
+	assert.Len(t, runner.CallsWithPrefix("ceph --mon-host mon1 --id admin fs authorize cephfs client.docker.vol /vol rw"), 1)
+
+	keyring := d.keyringFile("vol")
+	info, err := os.Stat(keyring)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	assert.Equal(t, "docker.vol", d.volumes.ByName("vol").Options["user"])
+	assert.Equal(t, "docker.vol", d.volumes.ByName("vol").Client)
+	assert.True(t, lib.IsDirectory(path.Join(cephRoot, "vol")))
+
+	secrets := fakeKernelSecrets(runner)
+	_, err = d.Mount(&volume.MountRequest{Name: "vol", ID: "c1"})
+	assert.Nil(t, err)
+	assert.Contains(t, runner.CallsWithPrefix("mount -t ceph ")[0], "name=docker.vol,secretfile=")
+	assert.Equal(t, []string{"AQVolKey==\n"}, *secrets)
+	assert.Nil(t, d.Unmount(&volume.UnmountRequest{Name: "vol", ID: "c1"}))
+
+	// The client stays while the directory can't be deleted
+	runner.On("mount -t ceph-fuse", "", errors.New("mount error"))
+	assert.NotNil(t, d.Remove(&volume.RemoveRequest{Name: "vol"}))
+	assert.Empty(t, runner.CallsWithPrefix("ceph --mon-host mon1 --id admin auth rm"))
+	runner.On("mount -t ceph-fuse", "", nil)
+
+	assert.Nil(t, d.Remove(&volume.RemoveRequest{Name: "vol"}))
+	assert.Len(t, runner.CallsWithPrefix("ceph --mon-host mon1 --id admin auth rm client.docker.vol"), 1)
+	_, err = os.Stat(keyring)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestAuthorizeExistingClient(t *testing.T) {
+	d, runner := newTestDriver(t)
+	cephRoot := fakeCephRoot(t, runner)
+	runner.On("ceph auth get client.docker.admin", "[client.docker.admin]\n\tkey = AQOperatorKey==", nil)
+
+	// A client the plugin didn't create is neither extended nor removed
+	err := d.Create(&volume.CreateRequest{Name: "admin", Options: map[string]string{"fsname": "cephfs", "authorize": "true"}})
+	assert.EqualError(t, err, lib.CLIENT_EXISTS+"client.docker.admin")
+	assert.Empty(t, runner.CallsWithPrefix("ceph --mon-host mon1 --id admin fs authorize"))
+	assert.Nil(t, d.volume("admin"))
+	// The new directory is rolled back
+	assert.False(t, lib.IsDirectory(path.Join(cephRoot, "admin")))
+
+	// An existing directory is kept
+	assert.Nil(t, os.Mkdir(path.Join(cephRoot, "admin"), os.ModePerm))
+	assert.NotNil(t, d.Create(&volume.CreateRequest{Name: "admin", Options: map[string]string{"fsname": "cephfs", "authorize": "true"}}))
+	assert.True(t, lib.IsDirectory(path.Join(cephRoot, "admin")))
+	assert.Empty(t, runner.CallsWithPrefix("ceph --mon-host mon1 --id admin auth rm"))
+}
+
+func TestRemove(t *testing.T) {
+	tests := []struct {
+		name	string
+		mounted	bool
+		inCeph	bool
+		err		string
+	}{
+		{"in use", true, true, lib.VOLUME_IN_USE+"vol"},
+		{"only local", false, false, ""},
+		{"in ceph", false, true, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			base, runner := newTestDriver(t)
+			cephRoot := fakeCephRoot(t, runner)
+			d, err := newCephFSDriver(runner, testConfig(base.defaultPath))
+			assert.Nil(t, err)
+			assert.Nil(t, d.Create(&volume.CreateRequest{Name: "vol", Options: map[string]string{"fsname": "cephfs"}}))
+			if(test.mounted) {
+				_, err := d.Mount(&volume.MountRequest{Name: "vol", ID: "c1"})
+				assert.Nil(t, err)
+			}
+			cephDir := path.Join(cephRoot, "vol")
+			if(test.inCeph) {
+				assert.Nil(t, os.MkdirAll(cephDir, os.ModePerm))
+			} else {
+				assert.Nil(t, os.RemoveAll(cephDir))
+			}
+			runner.Reset()
+
+			err = d.Remove(&volume.RemoveRequest{Name: "vol"})
+
+			if(len(test.err) > 0) {
+				assert.EqualError(t, err, test.err)
+				assert.NotNil(t, d.volumes.ByName("vol"))
+				return
+			}
+			assert.Nil(t, err)
+			assert.Nil(t, d.volumes.ByName("vol"))
+			assert.False(t, lib.IsDirectory(cephDir))
+			// The filesystem root was mounted on a private directory
+			// which is gone again
+			roots, _ := filepath.Glob(path.Join(d.defaultPath, "root-*"))
+			assert.Empty(t, roots)
+		})
+	}
+
+	d, _ := newTestDriver(t)
+	assert.EqualError(t, d.Remove(&volume.RemoveRequest{Name: "missing"}), lib.UNABLE_FIND_VOLUME+"missing")
+}
+
+func TestSnapshots(t *testing.T) {
+	d, runner := newTestDriver(t)
+	err := d.Create(&volume.CreateRequest{Name: "vol", Options: map[string]string{"fsname": "cephfs", "snapshot_keep_hourly": "-1"}})
+	assert.EqualError(t, err, lib.INVALID_SNAPSHOT_RETENTION+"-1")
+	assert.Nil(t, d.Create(&volume.CreateRequest{Name: "vol", Options: map[string]string{"fsname": "cephfs", "snapshot_keep_hourly": "1"}}))
+
+	// The mountpoint stands in for the mounted volume
+	res, err := d.Mount(&volume.MountRequest{Name: "vol", ID: "c1"})
+	assert.Nil(t, err)
+	assert.Nil(t, os.MkdirAll(path.Join(res.Mountpoint, ".snap"), os.ModePerm))
+
+	assert.Nil(t, d.CreateSnapshot("vol", "manual"))
+	assert.NotNil(t, d.CreateSnapshot("vol", "../escape"))
+	d.takeScheduledSnapshots(time.Now().Add(-2*time.Hour))
+	d.takeScheduledSnapshots(time.Now())
+
+	snaps, err := d.ListSnapshots("vol")
+	assert.Nil(t, err)
+	var names []string
+	for _, snap := range snaps {
+		names = append(names, snap.Name)
+	}
+	assert.Len(t, names, 2)
+	assert.Contains(t, names, "manual")
+	assert.Contains(t, names, lib.ScheduledSnapshotName(time.Now()))
+
+	get, err := d.Get(&volume.GetRequest{Name: "vol"})
+	assert.Nil(t, err)
+	assert.Len(t, get.Volume.Status["snapshots"], 2)
+
+	assert.Nil(t, d.DeleteSnapshot("vol", "manual"))
+	snaps, err = d.ListSnapshots("vol")
+	assert.Nil(t, err)
+	assert.Len(t, snaps, 1)
+
+	// An unused volume is read through the management mount of the
+	// index, nothing is mounted for Get
+	assert.Nil(t, d.Unmount(&volume.UnmountRequest{Name: "vol", ID: "c1"}))
+	mounts := newFakeStatfs()
+	d.inspector.Statfs = mounts.statfs
+	runner.Reset()
+	for i := 0; i < 3; i++ {
+		_, err = d.Get(&volume.GetRequest{Name: "vol"})
+		assert.Nil(t, err)
+	}
+	assert.Empty(t, runner.CallsWithPrefix("mount -t"))
+	assert.Empty(t, runner.CallsWithPrefix("umount"))
+	assert.Equal(t, 3, mounts.calls(path.Join(d.defaultPath, managementDir, "default", "cephfs")))
+}
+
+// fakeKernelSecrets records the keys passed to kernel mounts in secret
+// files, the files are gone after the mount.
+func fakeKernelSecrets(runner *lib.FakeRunner) *[]string {
+	var secrets []string
+	runner.OnFunc("mount -t ceph", func(name string, args ...string) (string, error) {
+		for _, option := range strings.Split(args[len(args)-1], ",") {
+			if(strings.HasPrefix(option, "secretfile=")) {
+				data, err := ioutil.ReadFile(strings.TrimPrefix(option, "secretfile="))
+				if(err != nil) {
+					return "", err
+				}
+				secrets = append(secrets, string(data))
+			}
+		}
+		return "", nil
+	})
+	return &secrets
+}
+
+// fakeCephRoot makes mounts of the filesystem root show the returned
+// directory by replacing the mountpoint with a symlink.
+func fakeCephRoot(t *testing.T, runner *lib.FakeRunner) string {
+	root, err := ioutil.TempDir("", "cephfs-root")
+	if(err != nil) {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(root) })
+
+	runner.OnFunc("mount -t", func(name string, args ...string) (string, error) {
+		if(strings.HasSuffix(args[2], ":/")) {
+			os.Remove(args[3])
+			return "", os.Symlink(root, args[3])
+		}
+		return "", nil
+	})
+	runner.OnFunc("umount", func(name string, args ...string) (string, error) {
+		if info, err := os.Lstat(args[0]); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			os.Remove(args[0])
+			return "", os.Mkdir(args[0], os.ModePerm)
+		}
+		return "", nil
+	})
+	return root
+}
+
+// fakeMountTable makes the given paths look like ceph-fuse mounts to the
+// mount inspector of the driver.
+func fakeMountTable(t *testing.T, d *cephFSDriver, mountpoints ...string) {
+	mountinfo := ""
+	types := make(map[string]bool)
+	for i, mountpoint := range mountpoints {
+		mountinfo += fmt.Sprintf("%d 22 0:%d / %s rw,relatime shared:1 - fuse.ceph-fuse ceph-fuse rw\n", 100+i, 50+i, mountpoint)
+		types[mountpoint] = true
+	}
+	file := path.Join(d.defaultPath, "mountinfo")
+	if err := ioutil.WriteFile(file, []byte(mountinfo), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	d.inspector = lib.NewMountInspector(file, mountCheckTimeout)
+	d.inspector.Statfs = func(file string, buf *syscall.Statfs_t) error {
+		if(types[file]) {
+			buf.Type = lib.FuseSuperMagic
+			return nil
+		}
+		return syscall.Statfs(file, buf)
+	}
+}
+
+// fakeStatfs answers statfs for mount checks, the dead paths fail like a
+// mount whose ceph-fuse daemon is gone. The probed paths are recorded.
+type fakeStatfs struct {
+	sync.Mutex
+	dead	map[string]bool
+	probed	[]string
+}
+
+func newFakeStatfs(dead ...string) *fakeStatfs {
+	f := &fakeStatfs{dead: make(map[string]bool)}
+	for _, file := range dead {
+		f.dead[file] = true
+	}
+	return f
+}
+
+func (f *fakeStatfs) statfs(file string, buf *syscall.Statfs_t) error {
+	f.Lock()
+	defer f.Unlock()
+	f.probed = append(f.probed, file)
+	if(f.dead[file]) {
+		return syscall.ENOTCONN
+	}
+	return nil
+}
+
+func (f *fakeStatfs) kill(file string) {
+	f.Lock()
+	defer f.Unlock()
+	f.dead[file] = true
+}
+
+func (f *fakeStatfs) calls(file string) int {
+	f.Lock()
+	defer f.Unlock()
+	count := 0
+	for _, probed := range f.probed {
+		if(probed == file) {
+			count++
+		}
+	}
+	return count
+}
+
+func (f *fakeStatfs) reset() []string {
+	f.Lock()
+	defer f.Unlock()
+	probed := f.probed
+	f.probed = nil
+	return probed
+}
+
+func waitClone(t *testing.T, d *cephFSDriver, name string) lib.Clone {
+	for i := 0; i < 500; i++ {
+		status := d.clones.status(name)
+		if(status != nil && status.State != lib.CloneCopying) {
+			return *status
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("clone of " + name + " didn't finish")
+	return lib.Clone{}
+}
+
+func TestClone(t *testing.T) {
+	d, runner := newTestDriver(t)
+	cephRoot := fakeCephRoot(t, runner)
+
+	assert.Nil(t, d.Create(&volume.CreateRequest{Name: "prod", Options: map[string]string{"fsname": "cephfs"}}))
+	assert.Nil(t, ioutil.WriteFile(path.Join(cephRoot, "prod", "data.txt"), []byte("current"), 0644))
+	assert.Nil(t, os.MkdirAll(path.Join(cephRoot, "prod", ".snap", "nightly"), os.ModePerm))
+	assert.Nil(t, ioutil.WriteFile(path.Join(cephRoot, "prod", ".snap", "nightly", "data.txt"), []byte("nightly"), 0644))
+
+	tests := []struct {
+		name	string
+		options	map[string]string
+		err		string
+		state	string
+		content	string
+	}{
+		{"unknown source", map[string]string{"from": "other"}, lib.UNABLE_FIND_VOLUME+"other", "", ""},
+		{"both sources", map[string]string{"from": "prod", "from_snapshot": "prod@nightly"}, lib.INVALID_CLONE_SOURCE+"use either from or from_snapshot", "", ""},
+		{"volume", map[string]string{"from": "prod"}, "", lib.CloneComplete, "current"},
+		{"snapshot", map[string]string{"from_snapshot": "prod@nightly"}, "", lib.CloneComplete, "nightly"},
+		{"missing snapshot", map[string]string{"from_snapshot": "prod@weekly"}, "", lib.CloneFailed, ""},
+	}
+
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			name := fmt.Sprintf("staging%d", i)
+			test.options["fsname"] = "cephfs"
+
+			err := d.Create(&volume.CreateRequest{Name: name, Options: test.options})
+
+			if(len(test.err) > 0) {
+				assert.EqualError(t, err, test.err)
+				return
+			}
+			assert.Nil(t, err)
+			clone := waitClone(t, d, name)
+			assert.Equal(t, test.state, clone.State)
+			assert.Equal(t, "prod", clone.Source)
+
+			res, err := d.Get(&volume.GetRequest{Name: name})
+			assert.Nil(t, err)
+			assert.Equal(t, clone, res.Volume.Status["clone"])
+
+			_, err = d.Mount(&volume.MountRequest{Name: name, ID: "c1"})
+			if(test.state != lib.CloneComplete) {
+				assert.EqualError(t, err, lib.CLONE_NOT_COMPLETE+name)
+				return
+			}
+			assert.Nil(t, err)
+			data, err := ioutil.ReadFile(path.Join(cephRoot, name, "data.txt"))
+			assert.Nil(t, err)
+			assert.Equal(t, test.content, string(data))
+			assert.Equal(t, uint64(len(test.content)), clone.BytesCopied)
+		})
+	}
+
+	// Finished clones aren't copied again after a restart
+	assert.Nil(t, ioutil.WriteFile(path.Join(cephRoot, "staging2", "data.txt"), []byte("changed"), 0644))
+	restarted, err := newCephFSDriver(runner, testConfig(d.defaultPath))
+	assert.Nil(t, err)
+	assert.Equal(t, lib.CloneComplete, waitClone(t, &restarted, "staging2").State)
+	assert.Equal(t, lib.CloneFailed, waitClone(t, &restarted, "staging4").State)
+	data, err := ioutil.ReadFile(path.Join(cephRoot, "staging2", "data.txt"))
+	assert.Nil(t, err)
+	assert.Equal(t, "changed", string(data))
+}
+
+// fakeSubvolumes answers the subvolume commands of the group docker from
+// the returned set of subvolume names.
+func fakeSubvolumes(runner *lib.FakeRunner) map[string]bool {
+	subvols := make(map[string]bool)
+	var mutex sync.Mutex
+	subvolume := func(args []string, command string) string {
+		for i, arg := range args {
+			if(arg == command) {
+				return args[i+2]
+			}
+		}
+		return ""
+	}
+
+	runner.OnFunc("ceph fs subvolume create", func(name string, args ...string) (string, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		subvols[subvolume(args, "create")] = true
+		return "", nil
+	})
+	runner.OnFunc("ceph fs subvolume snapshot clone", func(name string, args ...string) (string, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		for i, arg := range args {
+			if(arg == "clone") {
+				subvols[args[i+4]] = true
+			}
+		}
+		return "", nil
+	})
+	runner.OnFunc("ceph fs subvolume rm", func(name string, args ...string) (string, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		delete(subvols, subvolume(args, "rm"))
+		return "", nil
+	})
+	runner.OnFunc("ceph fs subvolume info", func(name string, args ...string) (string, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		sub := subvolume(args, "info")
+		if(!subvols[sub]) {
+			return "", &lib.CommandError{Command: "ceph", ExitCode: 2}
+		}
+		return `{"bytes_quota": 1024, "bytes_used": 512, "path": "/volumes/docker/`+sub+`/uuid"}`, nil
+	})
+	runner.OnFunc("ceph fs subvolume ls", func(name string, args ...string) (string, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		var entries []string
+		for sub := range subvols {
+			entries = append(entries, `{"name": "`+sub+`"}`)
+		}
+		return "["+strings.Join(entries, ",")+"]", nil
+	})
+	runner.On("ceph fs subvolume snapshot ls", `[{"name": "nightly"}]`, nil)
+	runner.On("ceph fs subvolume snapshot info", `{"created_at": "2024-03-11 12:30:00.000000"}`, nil)
+	runner.On("ceph fs clone status", `{"status": {"state": "complete"}}`, nil)
+	return subvols
+}
+
+func TestSubvolumes(t *testing.T) {
+	base, runner := newTestDriver(t)
+	subvols := fakeSubvolumes(runner)
+	config := testConfig(base.defaultPath)
+	config.Backend = lib.BackendSubvolume
+	d, err := newCephFSDriver(runner, config)
+	assert.Nil(t, err)
+	runner.Reset()
+
+	err = d.Create(&volume.CreateRequest{Name: "vol", Options: map[string]string{"fsname": "cephfs", "subpath": "/data"}})
+	assert.EqualError(t, err, lib.SUBPATH_WITH_SUBVOLUME)
+
+	assert.Nil(t, d.Create(&volume.CreateRequest{Name: "vol", Options: map[string]string{"fsname": "cephfs", "quota_bytes": "1024"}}))
+	assert.True(t, subvols["vol"])
+	assert.Len(t, runner.CallsWithPrefix("ceph --mon-host mon1 --id admin fs subvolumegroup create cephfs docker"), 1)
+	assert.Len(t, runner.CallsWithPrefix("ceph --mon-host mon1 --id admin fs subvolume create cephfs vol --size 1024 --group_name docker"), 1)
+	assert.Equal(t, "/volumes/docker/vol/uuid", d.volumes.ByName("vol").Subpath)
+
+	// Creating it again with another size resizes it
+	assert.Nil(t, d.Create(&volume.CreateRequest{Name: "vol", Options: map[string]string{"fsname": "cephfs", "quota_bytes": "2048"}}))
+	assert.Len(t, runner.CallsWithPrefix("ceph --mon-host mon1 --id admin fs subvolume resize cephfs vol 2048 --group_name docker"), 1)
+
+	res, err := d.Mount(&volume.MountRequest{Name: "vol", ID: "c1"})
+	assert.Nil(t, err)
+	assert.Contains(t, runner.CallsWithPrefix("mount -t ceph-fuse")[len(runner.CallsWithPrefix("mount -t ceph-fuse"))-1], "mon1:/volumes/docker/vol/uuid "+res.Mountpoint)
+	assert.Nil(t, d.Unmount(&volume.UnmountRequest{Name: "vol", ID: "c1"}))
+
+	// Snapshots and their clones are handled by ceph
+	assert.Nil(t, d.CreateSnapshot("vol", "nightly"))
+	assert.Len(t, runner.CallsWithPrefix("ceph --mon-host mon1 --id admin fs subvolume snapshot create cephfs vol nightly --group_name docker"), 1)
+	get, err := d.Get(&volume.GetRequest{Name: "vol"})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(512), get.Volume.Status["used_bytes"])
+	assert.Len(t, get.Volume.Status["snapshots"], 1)
+
+	cloneStatusInterval = time.Millisecond
+	assert.Nil(t, d.Create(&volume.CreateRequest{Name: "copy", Options: map[string]string{"fsname": "cephfs", "from_snapshot": "vol@nightly"}}))
+	assert.Equal(t, lib.CloneComplete, waitClone(t, &d, "copy").State)
+	assert.Len(t, runner.CallsWithPrefix("ceph --mon-host mon1 --id admin fs subvolume snapshot clone cephfs vol nightly copy --group_name docker --target_group_name docker"), 1)
+	// Get leaves the volume alone, the path is resolved by the first mount
+	get, err = d.Get(&volume.GetRequest{Name: "copy"})
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(512), get.Volume.Status["used_bytes"])
+	assert.Equal(t, "", d.volumes.ByName("copy").Subpath)
+	_, err = d.Mount(&volume.MountRequest{Name: "copy", ID: "c2"})
+	assert.Nil(t, err)
+	assert.Equal(t, "/volumes/docker/copy/uuid", d.volumes.ByName("copy").Subpath)
+	assert.Nil(t, d.Unmount(&volume.UnmountRequest{Name: "copy", ID: "c2"}))
+
+	// A clone which ceph finished while the plugin was down isn't issued again
+	state, err := lib.LoadState(d.stateFile)
+	assert.Nil(t, err)
+	for i := range state.Volumes {
+		if(state.Volumes[i].Clone != nil) {
+			assert.Equal(t, lib.CloneComplete, state.Volumes[i].Clone.State)
+			state.Volumes[i].Clone.State = lib.CloneCopying
+		}
+	}
+	assert.Nil(t, state.Save(d.stateFile))
+	restarted, err := newCephFSDriver(runner, config)
+	assert.Nil(t, err)
+	assert.Equal(t, lib.CloneComplete, waitClone(t, &restarted, "copy").State)
+	assert.Len(t, runner.CallsWithPrefix("ceph --mon-host mon1 --id admin fs subvolume snapshot clone"), 1)
+
+	// Removing deletes the snapshots first
+	assert.Nil(t, d.Remove(&volume.RemoveRequest{Name: "vol"}))
+	assert.Len(t, runner.CallsWithPrefix("ceph --mon-host mon1 --id admin fs subvolume snapshot rm cephfs vol nightly --group_name docker"), 1)
+	assert.False(t, subvols["vol"])
+	assert.Nil(t, d.volumes.ByName("vol"))
+}
+
+func TestDiscoverNestedVolumes(t *testing.T) {
+	d, runner := newTestDriver(t)
+	cephRoot := fakeCephRoot(t, runner)
+	config := testConfig(d.defaultPath)
+	config.Naming = NamingConfig{Separator: ".", Depth: 3}
+	nested, err := newCephFSDriver(runner, config)
+	assert.Nil(t, err)
+
+	err = nested.Create(&volume.CreateRequest{Name: "dataio.fileStore", Options: map[string]string{"fsname": "cephfs"}})
+	assert.EqualError(t, err, lib.INVALID_VOLUME_NAME+"dataio.fileStore")
+	for _, name := range []string{"staging.dataio.fileStore", "prod.dataio.fileStore", "prod.web.assets"} {
+		assert.Nil(t, nested.Create(&volume.CreateRequest{Name: name, Options: map[string]string{"fsname": "cephfs"}}))
+	}
+	assert.True(t, lib.IsDirectory(path.Join(cephRoot, "staging", "dataio", "fileStore")))
+	// Directories above or below the configured depth aren't volumes
+	assert.Nil(t, os.MkdirAll(path.Join(cephRoot, "prod", "empty"), os.ModePerm))
+	assert.Nil(t, os.MkdirAll(path.Join(cephRoot, "prod", "web", "assets", "css"), os.ModePerm))
+
+	// Without the state file all volumes are found again
+	assert.Nil(t, os.Remove(nested.stateFile))
+	restored, err := newCephFSDriver(runner, config)
+	assert.Nil(t, err)
+	var names []string
+	for _, vol := range restored.volumes {
+		names = append(names, vol.Name)
+	}
+	assert.ElementsMatch(t, []string{"staging.dataio.fileStore", "prod.dataio.fileStore", "prod.web.assets"}, names)
+	assert.Equal(t, "/prod/web/assets", restored.volumes.ByName("prod.web.assets").Subpath)
+}
+
+func TestCheckRoot(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+	dir, err := ioutil.TempDir("", "cephfs-rootcheck")
+	if(err != nil) {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	root := path.Join(dir, "plugin", "_cephfs")
+	mountinfo := path.Join(dir, "mountinfo")
+	assert.Nil(t, ioutil.WriteFile(mountinfo, []byte(fmt.Sprintf("100 22 0:50 / %s rw - fuse.ceph-fuse ceph-fuse rw\n", root)), 0600))
+
+	// The root is local until it is mounted
+	var mounted bool
+	inspector := lib.NewMountInspector(mountinfo, mountCheckTimeout)
+	inspector.Statfs = func(file string, buf *syscall.Statfs_t) error {
+		if(mounted && file == root) {
+			buf.Type = lib.FuseSuperMagic
+			return nil
+		}
+		return syscall.Statfs(file, buf)
+	}
+	runner := lib.NewFakeRunner()
+	runner.OnFunc("mount -t", func(name string, args ...string) (string, error) {
+		mounted = true
+		return "", nil
+	})
+	config := testConfig(root)
+	config.Filesystem = "cephfs"
+
+	assert.Nil(t, checkRoot(context.Background(), runner, inspector, config))
+	config.RootCheck = rootCheckRefuse
+	assert.EqualError(t, checkRoot(context.Background(), runner, inspector, config), lib.ROOT_NOT_CEPH+root)
+	assert.Empty(t, runner.Calls())
+	assert.False(t, lib.IsDirectory(root))
+
+	config.RootCheck = rootCheckMount
+	assert.Nil(t, checkRoot(context.Background(), runner, inspector, config))
+	assert.True(t, lib.IsDirectory(root))
+	assert.Equal(t, []string{
+		"mount -t ceph-fuse mon1:/ "+root+" -o name=admin,secretfile=/etc/ceph/admin.secret",
+		"umount "+root,
+		"mount -t ceph-fuse mon1:/"+pluginDir+" "+root+" -o name=admin,secretfile=/etc/ceph/admin.secret",
+	}, runner.Calls())
+
+	// A root on ceph is left alone
+	runner.Reset()
+	config.RootCheck = rootCheckRefuse
+	assert.Nil(t, checkRoot(context.Background(), runner, inspector, config))
+	assert.Empty(t, runner.Calls())
+
+	// A failed mount refuses to start
+	mounted = false
+	config.RootCheck = rootCheckMount
+	runner.On("mount -t", "", errors.New("mount error"))
+	assert.NotNil(t, checkRoot(context.Background(), runner, inspector, config))
+
+	// Only warn ignores a root which can't be probed
+	inspector.Statfs = func(file string, buf *syscall.Statfs_t) error {
+		return syscall.ENOTCONN
+	}
+	assert.NotNil(t, checkRoot(context.Background(), runner, inspector, config))
+	config.RootCheck = rootCheckWarn
+	assert.Nil(t, checkRoot(context.Background(), runner, inspector, config))
+}
+
+func TestCheckRootMount(t *testing.T) {
+	base, runner := newTestDriver(t)
+	cephRoot := fakeCephRoot(t, runner)
+	root := path.Join(base.defaultPath, "plugin")
+	config := testConfig(root)
+	config.Filesystem = "cephfs"
+	config.RootCheck = rootCheckMount
+
+	// The plugin directory of the filesystem is mounted on the root
+	file := path.Join(base.defaultPath, "mountinfo")
+	assert.Nil(t, ioutil.WriteFile(file, []byte(fmt.Sprintf("100 22 0:50 /%s %s rw - fuse.ceph-fuse ceph-fuse rw\n", pluginDir, root)), 0600))
+	defer func(orig string) { mountInfoFile = orig }(mountInfoFile)
+	mountInfoFile = file
+	defer func(orig func(string, *syscall.Statfs_t) error) { statfs = orig }(statfs)
+	statfs = func(file string, buf *syscall.Statfs_t) error {
+		if(file == root && len(runner.CallsWithPrefix("mount -t ceph-fuse mon1:/"+pluginDir)) > 0) {
+			buf.Type = lib.FuseSuperMagic
+			return nil
+		}
+		return syscall.Statfs(file, buf)
+	}
+	assert.Nil(t, checkRoot(context.Background(), runner, lib.MountInspector{MountInfo: file, Statfs: statfs}, config))
+	assert.True(t, lib.IsDirectory(path.Join(cephRoot, pluginDir)))
+
+	// The driver keeps the mount of its root and the plugin directory
+	// isn't a volume
+	runner.Reset()
+	d, err := newCephFSDriver(runner, config)
+	assert.Nil(t, err)
+	assert.Empty(t, runner.CallsWithPrefix("umount"))
+	res, err := d.List()
+	assert.Nil(t, err)
+	assert.Empty(t, res.Volumes)
 }
@@ -0,0 +1,195 @@
+package main
+
+import (
+	lib "./lib"
+
+	"github.com/Sirupsen/logrus"
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	healthInterval = 30 * time.Second
+
+	mountHealthy	= "healthy"
+	mountUnhealthy	= "unhealthy"
+	mountUnmounted	= "unmounted"
+)
+
+type mountHealth struct {
+	state		string
+	lastFailure	time.Time
+	err			string
+	remounts	int
+}
+
+// healthStates keeps the result of the last health check of each mounted volume.
+type healthStates struct {
+	sync.Mutex
+	volumes	map[string]*mountHealth
+}
+
+func newHealthStates() *healthStates {
+	return &healthStates{volumes: make(map[string]*mountHealth)}
+}
+
+func (h *healthStates) entry(name string) *mountHealth {
+	health, ok := h.volumes[name]
+	if(!ok) {
+		health = &mountHealth{state: mountHealthy}
+		h.volumes[name] = health
+	}
+	return health
+}
+
+func (h *healthStates) healthy(name string) {
+	h.Lock()
+	defer h.Unlock()
+
+	h.entry(name).state = mountHealthy
+}
+
+// failed records a failed check with the error of the check, or of the
+// remount if the mount couldn't be replaced.
+func (h *healthStates) failed(name string, err error, remounted bool, now time.Time) {
+	h.Lock()
+	defer h.Unlock()
+
+	health := h.entry(name)
+	health.lastFailure = now
+	health.err = err.Error()
+	health.state = mountUnhealthy
+	if(remounted) {
+		health.state = mountHealthy
+		health.remounts++
+	}
+}
+
+// unhealthy reports whether the last remount of a volume failed.
+func (h *healthStates) unhealthy(name string) bool {
+	h.Lock()
+	defer h.Unlock()
+
+	health, ok := h.volumes[name]
+	return ok && health.state == mountUnhealthy
+}
+
+func (h *healthStates) remove(name string) {
+	h.Lock()
+	defer h.Unlock()
+
+	delete(h.volumes, name)
+}
+
+// status describes the health of a volume mount for the volume status.
+func (h *healthStates) status(name string, mounted bool) map[string]interface{} {
+	h.Lock()
+	defer h.Unlock()
+
+	status := map[string]interface{}{"state": mountUnmounted}
+	health, ok := h.volumes[name]
+	if(mounted) {
+		status["state"] = mountHealthy
+		if(ok) {
+			status["state"] = health.state
+		}
+	}
+	if(ok && !health.lastFailure.IsZero()) {
+		status["last_failure"] = health.lastFailure.UTC().Format(time.RFC3339)
+		status["error"] = health.err
+		status["remounts"] = health.remounts
+	}
+	return status
+}
+
+// RunHealthMonitor checks the mounts of all volumes used by containers each
+// interval, until stop is closed.
+func (d *cephFSDriver) RunHealthMonitor(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			d.checkMounts()
+		}
+	}
+}
+
+// checkMounts stats the mountpoint of each mounted volume. A mount which
+// hangs or lost its ceph-fuse daemon is lazily unmounted and mounted again
+// on the same mountpoint.
+func (d *cephFSDriver) checkMounts() {
+	for _, vol := range d.volumeList() {
+		if(d.mountCount(vol.Name) == 0) {
+			continue
+		}
+		d.checkVolumeMount(vol.Name)
+	}
+}
+
+func (d *cephFSDriver) checkVolumeMount(name string) {
+	unlock := d.locks.Lock(name)
+	defer unlock()
+
+	// Unmounted or removed in the meantime
+	vol := d.volume(name)
+	if(vol == nil || d.mountCount(name) == 0) {
+		return
+	}
+
+	ctx, cancel := d.newContext()
+	defer cancel()
+
+	// After a failed remount nothing is mounted, the mountpoint itself is fine
+	if(!d.health.unhealthy(name)) {
+		err := d.inspector.Check(vol.Filesystem.Path)
+		if(err == nil) {
+			d.health.healthy(name)
+			return
+		}
+		logrus.Warn(err.Error(), ", remounting ", name, " ...")
+
+		rerr := d.remount(ctx, *vol)
+		if(rerr != nil) {
+			logrus.Error(rerr.Error())
+			d.health.failed(name, rerr, false, time.Now())
+			return
+		}
+		logrus.Info("Remounted ", name)
+		d.health.failed(name, err, true, time.Now())
+		return
+	}
+
+	logrus.Info("Retrying mount of ", name, " ...")
+	err := d.remount(ctx, *vol)
+	if(err != nil) {
+		logrus.Error(err.Error())
+		d.health.failed(name, err, false, time.Now())
+		return
+	}
+	logrus.Info("Remounted ", name)
+	d.health.healthy(name)
+}
+
+// remount replaces the mount of a volume by a new one.
+func (d *cephFSDriver) remount(ctx context.Context, vol lib.Volume) error {
+	cluster, err := d.mountCluster(vol)
+	if(err != nil) {
+		return err
+	}
+
+	// A lazy unmount doesn't wait for the dead filesystem, it fails if a
+	// previous remount left nothing mounted
+	if(lib.IsMountpoint(vol.Filesystem.Path) || !d.health.unhealthy(vol.Name)) {
+		_, err = d.runner.Run(ctx, "umount", "-l", vol.Filesystem.Path)
+		if(err != nil) {
+			return errors.New(lib.UNABLE_UNMOUNT+err.Error())
+		}
+	}
+	return vol.Mount(ctx, d.runner, cluster)
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	lib "./lib"
+
+	"github.com/Sirupsen/logrus"
+	"context"
+	"errors"
+	"os"
+	"path"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const managementDir = "manage"
+
+var mountCheckTimeout = 10 * time.Second
+
+// statfs probes the filesystems of mounts, tests replace it.
+var statfs = syscall.Statfs
+
+// managementMounts keeps the filesystem roots mounted which are used to
+// index the volumes, by mountpoint.
+type managementMounts struct {
+	sync.Mutex
+	mounted	map[string]bool
+}
+
+func newManagementMounts() *managementMounts {
+	return &managementMounts{mounted: make(map[string]bool)}
+}
+
+// clusterIndex is the result of the last refresh of a cluster.
+type clusterIndex struct {
+	volumes		lib.VolumeList
+	refreshed	time.Time
+	err			error
+}
+
+// volumeIndex caches the volumes found in the clusters, List is served from
+// it instead of the clusters.
+type volumeIndex struct {
+	sync.Mutex
+	interval	time.Duration
+	clusters	map[string]*clusterIndex
+}
+
+func newVolumeIndex(interval time.Duration) *volumeIndex {
+	return &volumeIndex{interval: interval, clusters: make(map[string]*clusterIndex)}
+}
+
+// update stores the result of a refresh, a failed refresh keeps the volumes
+// found before.
+func (i *volumeIndex) update(cluster string, vols lib.VolumeList, err error, now time.Time) {
+	i.Lock()
+	defer i.Unlock()
+
+	entry, ok := i.clusters[cluster]
+	if(!ok) {
+		entry = &clusterIndex{}
+		i.clusters[cluster] = entry
+	}
+	entry.err = err
+	if(err == nil) {
+		entry.volumes = vols
+		entry.refreshed = now
+	}
+}
+
+// volumes returns a copy of the volumes of all clusters.
+func (i *volumeIndex) volumes() lib.VolumeList {
+	i.Lock()
+	defer i.Unlock()
+
+	var vols lib.VolumeList
+	for _, entry := range i.clusters {
+		vols = append(vols, entry.volumes...)
+	}
+	return vols
+}
+
+// loaded reports whether every cluster was refreshed at least once.
+func (i *volumeIndex) loaded(clusters []lib.Cluster) bool {
+	i.Lock()
+	defer i.Unlock()
+
+	for _, cluster := range clusters {
+		entry, ok := i.clusters[cluster.Name]
+		if(!ok || entry.refreshed.IsZero()) {
+			return false
+		}
+	}
+	return true
+}
+
+// add puts a volume created by the driver into the index without a refresh.
+func (i *volumeIndex) add(vol lib.Volume) {
+	i.Lock()
+	defer i.Unlock()
+
+	entry, ok := i.clusters[vol.Cluster]
+	if(!ok) {
+		return
+	}
+	entry.volumes = append(entry.volumes.Remove(vol.Name), vol)
+}
+
+// remove drops a volume removed by the driver from the index.
+func (i *volumeIndex) remove(name string) {
+	i.Lock()
+	defer i.Unlock()
+
+	for _, entry := range i.clusters {
+		entry.volumes = entry.volumes.Remove(name)
+	}
+}
+
+// status describes how current the index of a cluster is. The index is
+// stale if its last refresh failed or is overdue.
+func (i *volumeIndex) status(cluster string, now time.Time) map[string]interface{} {
+	i.Lock()
+	defer i.Unlock()
+
+	status := map[string]interface{}{"stale": true}
+	entry, ok := i.clusters[cluster]
+	if(!ok) {
+		return status
+	}
+	if(!entry.refreshed.IsZero()) {
+		age := now.Sub(entry.refreshed)
+		status["refreshed"] = entry.refreshed.UTC().Format(time.RFC3339)
+		status["age_seconds"] = int64(age.Seconds())
+		status["stale"] = entry.err != nil || (i.interval > 0 && age > 2*i.interval)
+	}
+	if(entry.err != nil) {
+		status["error"] = entry.err.Error()
+	}
+	return status
+}
+
+// managementMount returns the root of a filesystem mounted with the admin
+// credentials. The mount is kept for later calls and checked before each
+// use, an unresponsive mount is lazily unmounted and mounted again.
+func (d *cephFSDriver) managementMount(ctx context.Context, cluster lib.Cluster, fs lib.Filesystem) (string, error) {
+	dir := path.Join(d.defaultPath, managementDir, cluster.Name, fs.Name)
+
+	d.manage.Lock()
+	defer d.manage.Unlock()
+
+	if(d.manage.mounted[dir] || lib.IsMountpoint(dir)) {
+		err := d.inspector.Check(dir)
+		if(err == nil) {
+			d.manage.mounted[dir] = true
+			return dir, nil
+		}
+		logrus.Warn(err.Error(), ", remounting ...")
+		delete(d.manage.mounted, dir)
+		d.runner.Run(ctx, "umount", "-l", dir)
+	} else if _, err := os.Stat(dir); err != nil && !os.IsNotExist(err) {
+		// A dead mount left behind by a previous run of the plugin
+		logrus.Warn("Unmounting stale management mount ", dir, " ...")
+		d.runner.Run(ctx, "umount", "-l", dir)
+	}
+
+	err := os.MkdirAll(dir, os.ModePerm)
+	if(err != nil) {
+		return "", errors.New(lib.UNABLE_CREATE_DIR+err.Error())
+	}
+
+	logrus.Info("Mounting management mount ", dir, " ...")
+	fsvol := lib.Volume{
+		Name: "root",
+		Subpath: "/",
+		Filesystem: fs,
+		MountType: d.mountType,
+	}
+	fsvol.Filesystem.Path = dir
+	err = fsvol.Mount(ctx, d.runner, cluster)
+	if(err != nil) {
+		return "", err
+	}
+	d.manage.mounted[dir] = true
+	return dir, nil
+}
+
+// indexClusterVolumes lists the volumes of all filesystems of a cluster
+// through their management mounts.
+func (d *cephFSDriver) indexClusterVolumes(ctx context.Context, cluster lib.Cluster) (lib.VolumeList, error) {
+	fss, err := lib.GetCephFilesystems(ctx, d.runner, cluster, "")
+	if(err != nil) {
+		return nil, err
+	}
+
+	var vols lib.VolumeList
+	for _, fs := range fss {
+		root, err := d.managementMount(ctx, cluster, fs)
+		if(err != nil) {
+			return nil, err
+		}
+		fsvols, err := fs.ListVolumes(ctx, d.runner, cluster, d.mountType, root, d.naming)
+		if(err != nil) {
+			return nil, err
+		}
+		vols = append(vols, fsvols...)
+	}
+	return d.withSubvolumes(ctx, cluster, vols)
+}
+
+// refreshIndex lists the volumes of all clusters again, the first error is
+// returned after all clusters were tried.
+func (d *cephFSDriver) refreshIndex(ctx context.Context) error {
+	var first error
+	for _, cluster := range d.clusterList() {
+		vols, err := d.indexClusterVolumes(ctx, cluster)
+		if(err != nil) {
+			err = errors.New(lib.UNABLE_GET_VOLUMES+err.Error())
+			logrus.Error(err.Error())
+			if(first == nil) {
+				first = err
+			}
+		}
+		d.index.update(cluster.Name, vols, err, time.Now())
+	}
+	return first
+}
+
+// RunIndexRefresh refreshes the volume index each interval and whenever a
+// signal is received on refresh, until stop is closed. An interval of 0
+// only refreshes on demand.
+func (d *cephFSDriver) RunIndexRefresh(interval time.Duration, refresh <-chan os.Signal, stop <-chan struct{}) {
+	var tick <-chan time.Time
+	if(interval > 0) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-tick:
+		case <-refresh:
+			logrus.Info("Refreshing volume index on demand ...")
+		}
+		ctx, cancel := d.newContext()
+		d.refreshIndex(ctx)
+		cancel()
+	}
+}
@@ -0,0 +1,179 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Docker mounts the secrets of a plugin into this directory.
+const DockerSecretsDir = "/run/secrets"
+
+// DockerSecretPath returns the file of the docker secret name.
+func DockerSecretPath(name string) (string, error) {
+	if(len(name) == 0 || strings.ContainsAny(name, "/\\") || name == "." || name == "..") {
+		return "", errors.New(INVALID_SECRET_NAME+name)
+	}
+	return filepath.Join(DockerSecretsDir, name), nil
+}
+
+// ReadKey returns the cephx key of user from a keyring or from a file only
+// holding the key. Files outside of the docker secrets must only be
+// accessible by their owner.
+func ReadKey(file string, user string) (string, error) {
+	if(!strings.HasPrefix(file, DockerSecretsDir+"/")) {
+		err := checkSecretPermissions(file)
+		if(err != nil) {
+			return "", err
+		}
+	}
+
+	data, err := ioutil.ReadFile(file)
+	if(err != nil) {
+		return "", errors.New(UNABLE_READ_SECRET+err.Error())
+	}
+
+	if(bytes.Contains(data, []byte("["))) {
+		return parseKeyring(data, "client."+strings.TrimPrefix(user, "client."))
+	}
+
+	key := strings.TrimSpace(string(data))
+	if(len(key) == 0) {
+		return "", errors.New(UNABLE_READ_SECRET+"empty secret in "+file)
+	}
+	return key, nil
+}
+
+func checkSecretPermissions(file string) error {
+	info, err := os.Stat(file)
+	if(err != nil) {
+		return errors.New(UNABLE_READ_SECRET+err.Error())
+	}
+	if(info.Mode().Perm() & 0077 != 0) {
+		return errors.New(INSECURE_SECRET_FILE+file)
+	}
+	return nil
+}
+
+// parseKeyring returns the key of entity from a keyring like
+//
+//	[client.admin]
+//		key = AQBx...==
+func parseKeyring(data []byte, entity string) (string, error) {
+	section := ""
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if(strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]")) {
+			section = strings.TrimSpace(line[1:len(line)-1])
+			continue
+		}
+		if(section != entity) {
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if(len(parts) == 2 && strings.TrimSpace(parts[0]) == "key") {
+			return strings.TrimSpace(parts[1]), nil
+		}
+	}
+
+	return "", errors.New(MISSING_KEYRING_ENTRY+entity)
+}
+
+// ClientPrefix namespaces the ceph clients created for volumes.
+const ClientPrefix = "docker."
+
+// ClientID derives the cephx client id of a volume. Characters other than
+// letters, digits, '-' and '_' are escaped as '.' and two hex digits, so
+// different volume names never share a client.
+func ClientID(name string) string {
+	var b strings.Builder
+	b.WriteString(ClientPrefix)
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if((c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '-' || c == '_') {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, ".%02x", c)
+		}
+	}
+	return b.String()
+}
+
+// ClientExists reports whether client.id is known to the cluster.
+func (c Cluster) ClientExists(ctx context.Context, runner CommandRunner, id string) (bool, error) {
+	out, err := c.Ceph(ctx, runner, "auth", "get", "client."+id)
+	if(err != nil) {
+		if(strings.Contains(err.Error(), "ENOENT")) {
+			return false, nil
+		}
+		return false, errors.New(UNABLE_AUTHORIZE_CLIENT+err.Error())
+	}
+	_, err = parseKeyring([]byte(out), "client."+id)
+	return err == nil, nil
+}
+
+// AuthorizeClient creates (or fetches) the key of client.id restricted to
+// read/write access on subpath of the filesystem and returns its keyring.
+func (c Cluster) AuthorizeClient(ctx context.Context, runner CommandRunner, fsname string, id string, subpath string) (string, error) {
+	out, err := c.Ceph(ctx, runner, "fs", "authorize", fsname, "client."+id, subpath, "rw")
+	if(err != nil) {
+		return "", errors.New(UNABLE_AUTHORIZE_CLIENT+err.Error())
+	}
+
+	// Validate the returned keyring without logging it
+	_, err = parseKeyring([]byte(out), "client."+id)
+	if(err != nil) {
+		return "", errors.New(UNABLE_AUTHORIZE_CLIENT+err.Error())
+	}
+	return out+"\n", nil
+}
+
+// RevokeClient deletes client.id and its key.
+func (c Cluster) RevokeClient(ctx context.Context, runner CommandRunner, id string) error {
+	_, err := c.Ceph(ctx, runner, "auth", "rm", "client."+id)
+	if(err != nil) {
+		return errors.New(UNABLE_REVOKE_CLIENT+err.Error())
+	}
+	return nil
+}
+
+// writeSecretFile stores a key in a temporary file only readable by its
+// owner, the caller removes it.
+func writeSecretFile(key string) (string, error) {
+	f, err := ioutil.TempFile("", "ceph-secret-")
+	if(err != nil) {
+		return "", err
+	}
+	defer f.Close()
+
+	err = f.Chmod(0600)
+	if(err == nil) {
+		_, err = f.WriteString(key+"\n")
+	}
+	if(err != nil) {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// WriteKeyring stores a keyring only readable by its owner.
+func WriteKeyring(file string, keyring string) error {
+	err := os.MkdirAll(filepath.Dir(file), 0700)
+	if(err != nil) {
+		return errors.New(UNABLE_WRITE_KEYRING+err.Error())
+	}
+	err = ioutil.WriteFile(file, []byte(keyring), 0600)
+	if(err != nil) {
+		return errors.New(UNABLE_WRITE_KEYRING+err.Error())
+	}
+	return os.Chmod(file, 0600)
+}
@@ -0,0 +1,85 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testKeyring = `[client.admin]
+	key = AQAdminKey==
+	caps mds = "allow *"
+[client.team]
+	key = AQTeamKey==
+`
+
+func writeSecret(t *testing.T, content string, mode os.FileMode) string {
+	dir, err := ioutil.TempDir("", "cephfs-auth")
+	if(err != nil) {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	file := filepath.Join(dir, "secret")
+	if err := ioutil.WriteFile(file, []byte(content), mode); err != nil {
+		t.Fatal(err)
+	}
+	os.Chmod(file, mode)
+	return file
+}
+
+func TestReadKey(t *testing.T) {
+	tests := []struct {
+		name		string
+		content		string
+		mode		os.FileMode
+		user		string
+		key			string
+		err			bool
+	}{
+		{"plain key", "AQPlainKey==\n", 0600, "admin", "AQPlainKey==", false},
+		{"keyring", testKeyring, 0600, "team", "AQTeamKey==", false},
+		{"keyring with client prefix", testKeyring, 0400, "client.admin", "AQAdminKey==", false},
+		{"keyring without user", testKeyring, 0600, "other", "", true},
+		{"group readable", "AQPlainKey==", 0640, "admin", "", true},
+		{"world readable", testKeyring, 0644, "admin", "", true},
+		{"empty", "", 0600, "admin", "", true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			key, err := ReadKey(writeSecret(t, test.content, test.mode), test.user)
+
+			if(test.err) {
+				assert.NotNil(t, err)
+				return
+			}
+			assert.Nil(t, err)
+			assert.Equal(t, test.key, key)
+		})
+	}
+}
+
+func TestDockerSecretPath(t *testing.T) {
+	file, err := DockerSecretPath("team-key")
+	assert.Nil(t, err)
+	assert.Equal(t, "/run/secrets/team-key", file)
+
+	for _, name := range []string{"", "..", "../etc/shadow", "a/b"} {
+		_, err := DockerSecretPath(name)
+		assert.NotNil(t, err, name)
+	}
+}
+
+func TestClientID(t *testing.T) {
+	assert.Equal(t, "docker.vol", ClientID("vol"))
+	assert.Equal(t, "docker.admin", ClientID("admin"))
+	assert.Equal(t, "docker.team.2fa", ClientID("team/a"))
+	assert.Equal(t, "docker.team-a", ClientID("team-a"))
+	assert.Equal(t, "docker.staging.2edb", ClientID("staging.db"))
+	// Escapes can't be forged by the name
+	assert.NotEqual(t, ClientID("a.2fb"), ClientID("a/b"))
+}
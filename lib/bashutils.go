@@ -1,6 +1,10 @@
 package lib
 
-import "os"
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
 
 func IsDirectory(path string) bool {
 	fileInfo, err := os.Stat(path);
@@ -8,4 +12,17 @@ func IsDirectory(path string) bool {
 		return false
 	}
 	return fileInfo.IsDir()
-}
\ No newline at end of file
+}
+
+// IsMountpoint reports whether path is the root of a mount,
+// i.e. whether it lives on another device than its parent directory.
+func IsMountpoint(path string) bool {
+	var st, parent syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return false
+	}
+	if err := syscall.Stat(filepath.Join(path, ".."), &parent); err != nil {
+		return false
+	}
+	return st.Dev != parent.Dev || st.Ino == parent.Ino
+}
@@ -3,27 +3,49 @@ package lib
 import (
 	"github.com/Sirupsen/logrus"
 
+	"context"
 	"fmt"
 	"errors"
+	"os"
+	"path"
 	"strings"
 )
 
+const (
+	MountTypeFuse	= "fuse"
+	MountTypeKernel	= "kernel"
+)
+
 type Volume struct {
 	Name 		string
+	Cluster		string
 	Subpath		string
+	SubvolumeGroup	string
 	Filesystem	Filesystem
+	Options		map[string]string
+	MountType	string
+	// Client is the ceph client created for the volume, the only one the
+	// plugin may revoke
+	Client		string	`json:",omitempty"`
+	Quota		Quota	`json:"-"`
 }
 
 type VolumeList []Volume
 
 type Filesystem struct {
+	ID			int
 	Name 		string
 	Path 		string
 	DataPool 	string
+	DataPools	[]string
 	MetaPool 	string
+	MetaPoolID	int
 }
 
-func NewFilesystem(name 		string,
+func NewFilesystem(ctx			context.Context,
+					runner		CommandRunner,
+					cluster		Cluster,
+					name 		string,
 					path 		string,
 					dataPool 	string,
 					metaPool	string) (*Filesystem, error) {
@@ -34,21 +56,21 @@ func NewFilesystem(name 		string,
 		MetaPool: metaPool,
 	}
 
-	exists, err := ExistsCephPools(fs.MetaPool, fs.DataPool)
+	exists, err := ExistsCephPools(ctx, runner, cluster, fs.MetaPool, fs.DataPool)
 	if(err != nil) {
 		return nil, err
 	} else if(!exists) {
 		return nil, errors.New(MISSING_POOL)
 	}
 
-	out, err := ShWithDefaultTimeout("ceph", "fs", "new", fs.Name, fs.MetaPool, fs.DataPool)
+	out, err := cluster.Ceph(ctx, runner, "fs", "new", fs.Name, fs.MetaPool, fs.DataPool)
 	if(err != nil) {
-		err = InternalError(errors.New(out))
+		err = InternalError(err)
 		return nil, err
 	}
 	logrus.Debug(out)
 
-	exists, err = fs.Exists()
+	exists, err = fs.Exists(ctx, runner, cluster)
 	if(err != nil) {
 		return nil, err
 	}
@@ -64,33 +86,79 @@ func ( v Volume) GetAbsolutePathForVolume() string {
 	return fmt.Sprintf("%s/%s",v.Filesystem.Path, v.Subpath)
 }
 
-func (v Volume) Mount(monitor string, user string, secretfile string) error {
-	out, err := ShWithDefaultTimeout("mount", "-t",
-																"ceph-fuse",
-																monitor+":"+v.Subpath,
-																v.Filesystem.Path,
-																"-o",
-																"name="+user+",secretfile="+secretfile)
+func (v Volume) Mount(ctx context.Context, runner CommandRunner, cluster Cluster) error {
+	var out string
+	var err error
+
+	switch v.MountType {
+	case MountTypeKernel:
+		var key string
+		key, err = cluster.Key()
+		if(err != nil) {
+			return errors.New(UNABLE_MOUNT+err.Error())
+		}
+		// The key is handed over in a file, mount options are visible in ps
+		var file string
+		file, err = writeSecretFile(key)
+		if(err != nil) {
+			return errors.New(UNABLE_MOUNT+err.Error())
+		}
+		defer os.Remove(file)
+		options := "name="+cluster.ID()+",secretfile="+file
+		if(len(v.Filesystem.Name) > 0) {
+			options += ",mds_namespace="+v.Filesystem.Name
+		}
+		out, err = runner.Run(ctx, "mount", "-t",
+									"ceph",
+									cluster.Monitor()+":"+v.Subpath,
+									v.Filesystem.Path,
+									"-o",
+									options)
+	case MountTypeFuse, "":
+		options := "name="+cluster.User
+		if(len(cluster.Keyring) > 0) {
+			options += ",keyring="+cluster.Keyring
+		} else {
+			options += ",secretfile="+cluster.SecretFile
+		}
+		if(len(cluster.ConfPath) > 0) {
+			options += ",conf="+cluster.ConfPath
+		}
+		out, err = runner.Run(ctx, "mount", "-t",
+									"ceph-fuse",
+									cluster.Monitor()+":"+v.Subpath,
+									v.Filesystem.Path,
+									"-o",
+									options)
+	default:
+		return errors.New(INVALID_MOUNT_TYPE+v.MountType)
+	}
 	if(err != nil) {
-		err = InternalError(errors.New(out))
+		err = errors.New(UNABLE_MOUNT+err.Error())
 		return err
 	}
+	logrus.Debug(out)
 
 	return nil
 }
 
-func (v Volume) Unmount() error {
-	out, err := ShWithDefaultTimeout("umount", v.Filesystem.Path)
+// ValidMountType reports whether the mount type is supported.
+func ValidMountType(mountType string) bool {
+	return mountType == MountTypeFuse || mountType == MountTypeKernel
+}
+
+func (v Volume) Unmount(ctx context.Context, runner CommandRunner) error {
+	out, err := runner.Run(ctx, "umount", v.Filesystem.Path)
 	if(err != nil) {
-		err = InternalError(errors.New(out))
+		err = errors.New(UNABLE_UNMOUNT+err.Error())
 		return err
 	}
 	logrus.Debug(out)
 	return nil
 }
 
-func (fs Filesystem) Exists() (bool, error) {
-	fss, err := GetCephFilesystems("")
+func (fs Filesystem) Exists(ctx context.Context, runner CommandRunner, cluster Cluster) (bool, error) {
+	fss, err := GetCephFilesystems(ctx, runner, cluster, "")
 	if(err != nil) {
 		logrus.Error(err.Error())
 		return false, err
@@ -106,17 +174,17 @@ func (fs Filesystem) Exists() (bool, error) {
 	return false, nil
 }
 
-func GetVolumes(monitor string, user string, secretfile string, path string) (VolumeList, error) {
+func GetVolumes(ctx context.Context, runner CommandRunner, cluster Cluster, mountType string, path string, naming Naming) (VolumeList, error) {
 	var vols []Volume
 
-	fss, err := GetCephFilesystems(path)
+	fss, err := GetCephFilesystems(ctx, runner, cluster, path)
 	if(err != nil) {
 		return nil, err
 	}
 	logrus.Debug(fss)
 
 	for _, fs := range fss {
-		vols_part, err := fs.GetVolumes(monitor, user, secretfile)
+		vols_part, err := fs.GetVolumes(ctx, runner, cluster, mountType, naming)
 		if(err != nil) {
 			return nil, err
 		}
@@ -129,52 +197,107 @@ func GetVolumes(monitor string, user string, secretfile string, path string) (Vo
 	return vols, nil
 }
 
-func (fs Filesystem) GetVolumes(monitor string, user string, secretfile string) (VolumeList, error) {
-	var vols []Volume
-
+func (fs Filesystem) GetVolumes(ctx context.Context, runner CommandRunner, cluster Cluster, mountType string, naming Naming) (VolumeList, error) {
 	vol := Volume{
 		Name: "root",
 		Subpath: "/",
 		Filesystem: fs,
+		MountType: mountType,
 	}
-	err := vol.Mount(monitor, user, secretfile)
+	err := vol.Mount(ctx, runner, cluster)
 	if(err != nil) {
 		return nil, err
 	}
 
-	out, err := ShWithDefaultTimeout("ls", "-1", fs.Path)
+	vols, err := fs.ListVolumes(ctx, runner, cluster, mountType, fs.Path, naming)
 	if(err != nil) {
-		err = InternalError(errors.New(UNABLE_GET_VOLUMES+out))
+		vol.Unmount(ctx, runner)
 		return nil, err
 	}
-	logrus.Debug(out)
 
-	lines := strings.Split(out, "\n")
-	for _, line := range lines {
-		if(IsDirectory(fs.Path+"/"+line)) {
-			vols = append(vols, Volume{
-				Name: line,
-				Subpath: "/"+line,
-				Filesystem: fs,
-			})
-		}
+	err = vol.Unmount(ctx, runner)
+	if(err != nil) {
+		return nil, err
 	}
-	logrus.Debug(lines)
 
-	err = vol.Unmount()
+	return vols, nil
+}
+
+// ListVolumes returns the volumes of the filesystem whose root is mounted on root.
+func (fs Filesystem) ListVolumes(ctx context.Context, runner CommandRunner, cluster Cluster, mountType string, root string, naming Naming) (VolumeList, error) {
+	var vols []Volume
+
+	subpaths, err := listVolumeDirs(ctx, runner, root, "/", naming.Levels())
 	if(err != nil) {
 		return nil, err
 	}
+	logrus.Debug(subpaths)
+
+	fs.Path = root
+	for _, subpath := range subpaths {
+		quota, err := GetQuota(path.Join(root, subpath))
+		if(err != nil) {
+			logrus.Debug(err.Error())
+		}
+		vols = append(vols, Volume{
+			Name: naming.Name(subpath),
+			Subpath: subpath,
+			Cluster: cluster.Name,
+			Filesystem: fs,
+			MountType: mountType,
+			Quota: quota,
+		})
+	}
 
 	return vols, nil
 }
 
+// listVolumeDirs returns the directories levels deep below subpath of the mounted root.
+func listVolumeDirs(ctx context.Context, runner CommandRunner, root string, subpath string, levels int) ([]string, error) {
+	out, err := runner.Run(ctx, "ls", "-1", path.Join(root, subpath))
+	if(err != nil) {
+		err = errors.New(UNABLE_GET_VOLUMES+err.Error())
+		return nil, err
+	}
+	logrus.Debug(out)
+
+	var dirs []string
+	for _, line := range strings.Split(out, "\n") {
+		// Volume names start with a letter or digit, hidden directories
+		// like the one of the plugin root aren't volumes
+		child := path.Join(subpath, line)
+		if(len(line) == 0 || strings.HasPrefix(line, ".") || !IsDirectory(path.Join(root, child))) {
+			continue
+		}
+		if(levels <= 1) {
+			dirs = append(dirs, child)
+			continue
+		}
+		nested, err := listVolumeDirs(ctx, runner, root, child, levels-1)
+		if(err != nil) {
+			return nil, err
+		}
+		dirs = append(dirs, nested...)
+	}
+	return dirs, nil
+}
+
+// ByName returns the volume with the given name in the list, nil if there is none.
 func (vols VolumeList) ByName(name string) *Volume {
-	for _, vol := range vols {
-		logrus.Debug(vol)
-		if(vol.Name == name) {
-			return &vol
+	for i := range vols {
+		if(vols[i].Name == name) {
+			return &vols[i]
 		}
 	}
 	return nil
-}
\ No newline at end of file
+}
+
+func (vols VolumeList) Remove(name string) VolumeList {
+	var rest VolumeList
+	for _, vol := range vols {
+		if(vol.Name != name) {
+			rest = append(rest, vol)
+		}
+	}
+	return rest
+}
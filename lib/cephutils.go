@@ -1,70 +1,127 @@
 package lib
 
 import (
-	"strings"
+	"context"
+	"encoding/json"
 	"errors"
 	"github.com/Sirupsen/logrus"
 )
 
-func GetCephFilesystems(path string) ([]Filesystem, error) {
+// cephFsListEntry is one element of "ceph fs ls --format json".
+type cephFsListEntry struct {
+	Name			string		`json:"name"`
+	MetadataPool	string		`json:"metadata_pool"`
+	MetadataPoolID	int			`json:"metadata_pool_id"`
+	DataPoolIDs		[]int		`json:"data_pool_ids"`
+	DataPools		[]string	`json:"data_pools"`
+}
+
+// cephFsDump is the part of "ceph fs dump --format json" needed to get the filesystem IDs.
+type cephFsDump struct {
+	Filesystems	[]struct {
+		ID		int	`json:"id"`
+		MDSMap	struct {
+			FsName	string	`json:"fs_name"`
+		}	`json:"mdsmap"`
+	}	`json:"filesystems"`
+}
+
+func GetCephFilesystems(ctx context.Context, runner CommandRunner, cluster Cluster, path string) ([]Filesystem, error) {
 	// Check if ceph filesystem already exists
-	out, err := ShWithDefaultTimeout("ceph", "fs", "ls")
+	out, err := cluster.Ceph(ctx, runner, "fs", "ls", "--format", "json")
 	if(err != nil) {
 		return nil, errors.New(REQUEST_LIST_ERROR + err.Error())
 	}
 
+	existingFs, err := parseCephFilesystems([]byte(out), path)
+	if(err != nil) {
+		return nil, err
+	}
+
+	out, err = cluster.Ceph(ctx, runner, "fs", "dump", "--format", "json")
+	if(err != nil) {
+		return nil, errors.New(REQUEST_LIST_ERROR + err.Error())
+	}
+
+	ids, err := parseCephFilesystemIDs([]byte(out))
+	if(err != nil) {
+		return nil, err
+	}
+	for index := range existingFs {
+		existingFs[index].ID = ids[existingFs[index].Name]
+	}
+
+	return existingFs, nil
+}
+
+func parseCephFilesystems(data []byte, path string) ([]Filesystem, error) {
+	var entries []cephFsListEntry
+	err := json.Unmarshal(data, &entries)
+	if(err != nil) {
+		return nil, InternalError(errors.New(PROCESSING_LIST_ERROR+" "+err.Error()))
+	}
+
 	var existingFs []Filesystem
-	var index			int
-	filesystems := strings.Split(out, "\n")
-	for _, element := range filesystems {
-		properties := strings.Split(element, ", ")
-		if(len(properties) != 3) {
-			return nil, InternalError(errors.New(PROCESSING_LIST_ERROR))
+	for _, entry := range entries {
+		fs := Filesystem{
+			Name:       entry.Name,
+			Path:       path,
+			MetaPool:   entry.MetadataPool,
+			MetaPoolID: entry.MetadataPoolID,
+			DataPools:  entry.DataPools,
 		}
-
-		existingFs = append(existingFs, Filesystem{})
-		index = len(existingFs)-1
-		existingFs[index].Path = path
-		for _, property := range properties {
-			value := strings.Split(property, ": ")
-			if(len(value) != 2) {
-				return nil, InternalError(errors.New(PROCESSING_LIST_ERROR))
-			}
-
-			switch (value[0]) {
-			case "name":
-				existingFs[index].Name = value[1]
-			case "metapool":
-				existingFs[index].MetaPool = value[1]
-			case "data pools":
-				existingFs[index].DataPool = value[1]
-			}
+		if(len(entry.DataPools) > 0) {
+			fs.DataPool = entry.DataPools[0]
 		}
+		existingFs = append(existingFs, fs)
 	}
 
 	return existingFs, nil
 }
 
-func GetCephPools() ([]string, error) {
-	out, err := ShWithDefaultTimeout("ceph", "osd", "pool", "ls")
+func parseCephFilesystemIDs(data []byte) (map[string]int, error) {
+	var dump cephFsDump
+	err := json.Unmarshal(data, &dump)
+	if(err != nil) {
+		return nil, InternalError(errors.New(PROCESSING_DUMP_ERROR+" "+err.Error()))
+	}
+
+	ids := make(map[string]int)
+	for _, fs := range dump.Filesystems {
+		ids[fs.MDSMap.FsName] = fs.ID
+	}
+
+	return ids, nil
+}
+
+func GetCephPools(ctx context.Context, runner CommandRunner, cluster Cluster) ([]string, error) {
+	out, err := cluster.Ceph(ctx, runner, "osd", "pool", "ls", "--format", "json")
 	if(err != nil) {
 		err = errors.New(REQUEST_POOLS_ERROR+err.Error())
 		return nil, err
 	}
 	logrus.Debug(out)
 
-	pools := strings.Split(out, "\n")
+	return parseCephPools([]byte(out))
+}
+
+func parseCephPools(data []byte) ([]string, error) {
+	var pools []string
+	err := json.Unmarshal(data, &pools)
+	if(err != nil) {
+		return nil, InternalError(errors.New(PROCESSING_POOLS_ERROR+" "+err.Error()))
+	}
+
 	if(len(pools) == 0) {
-		err = errors.New(PROCESSING_POOLS_ERROR)
-		return nil, err
+		return nil, errors.New(MISSING_POOLS_ERROR)
 	}
 	logrus.Debug(pools)
 
 	return pools, nil
 }
 
-func ExistsCephPools(names... string) (bool, error) {
-	pools, err := GetCephPools()
+func ExistsCephPools(ctx context.Context, runner CommandRunner, cluster Cluster, names... string) (bool, error) {
+	pools, err := GetCephPools(ctx, runner, cluster)
 	if(err != nil) {
 		return false, err
 	}
@@ -0,0 +1,75 @@
+package lib
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readSample(t *testing.T, name string) []byte {
+	data, err := ioutil.ReadFile("testdata/"+name)
+	if(err != nil) {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestParseCephFilesystems(t *testing.T) {
+	fss, err := parseCephFilesystems(readSample(t, "fs_ls.json"), "/mnt")
+
+	assert.Nil(t, err)
+	assert.Equal(t, []Filesystem{
+		{
+			Name:       "cephfs",
+			Path:       "/mnt",
+			DataPool:   "cephfs_data",
+			DataPools:  []string{"cephfs_data"},
+			MetaPool:   "cephfs_metadata",
+			MetaPoolID: 2,
+		},
+		{
+			Name:       "teams",
+			Path:       "/mnt",
+			DataPool:   "teams_data",
+			DataPools:  []string{"teams_data", "teams_data_ec"},
+			MetaPool:   "teams_metadata",
+			MetaPoolID: 4,
+		},
+	}, fss)
+}
+
+func TestParseCephFilesystemsEmpty(t *testing.T) {
+	fss, err := parseCephFilesystems([]byte("[]"), "/mnt")
+
+	assert.Nil(t, err)
+	assert.Empty(t, fss)
+}
+
+func TestParseCephFilesystemsInvalid(t *testing.T) {
+	_, err := parseCephFilesystems([]byte("name: cephfs, metadata pool: cephfs_metadata, data pools: [cephfs_data ]"), "/mnt")
+
+	assert.NotNil(t, err)
+}
+
+func TestParseCephFilesystemIDs(t *testing.T) {
+	ids, err := parseCephFilesystemIDs(readSample(t, "fs_dump.json"))
+
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]int{"cephfs": 1, "teams": 2}, ids)
+}
+
+func TestParseCephPools(t *testing.T) {
+	pools, err := parseCephPools(readSample(t, "osd_pool_ls.json"))
+
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"rbd", "cephfs_data", "cephfs_metadata", "teams_data", "teams_metadata", "teams_data_ec"}, pools)
+	assert.True(t, existsCephPool(pools, "teams_data_ec"))
+	assert.False(t, existsCephPool(pools, "missing"))
+}
+
+func TestParseCephPoolsEmpty(t *testing.T) {
+	_, err := parseCephPools([]byte("[]"))
+
+	assert.EqualError(t, err, MISSING_POOLS_ERROR)
+}
@@ -0,0 +1,225 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	CloneCopying	= "copying"
+	CloneComplete	= "complete"
+	CloneFailed		= "failed"
+)
+
+// Clone is the progress of a volume which is filled from another volume.
+type Clone struct {
+	Source		string	`json:"source"`
+	Snapshot	string	`json:"snapshot,omitempty"`
+	State		string	`json:"state"`
+	BytesTotal	uint64	`json:"bytes_total"`
+	BytesCopied	uint64	`json:"bytes_copied"`
+	Progress	string	`json:"progress,omitempty"`
+	Error		string	`json:"error,omitempty"`
+}
+
+// ParseCloneSource splits a from_snapshot option of the form <volume>@<snapshot>.
+func ParseCloneSource(val string) (string, string, error) {
+	i := strings.LastIndex(val, "@")
+	if(i <= 0 || !ValidSnapshotName(val[i+1:])) {
+		return "", "", errors.New(INVALID_CLONE_SOURCE+val)
+	}
+	return val[:i], val[i+1:], nil
+}
+
+// CopyTree copies the directory src into the existing directory dst with the
+// given number of parallel workers. Directories are created up front, files
+// and symlinks are copied by the workers keeping mode, owner and times.
+// progress is called with the number of bytes copied since the last call.
+func CopyTree(ctx context.Context, src string, dst string, workers int, progress func(int64)) error {
+	if(workers < 1) {
+		workers = 1
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type job struct {
+		src		string
+		dst		string
+		info	os.FileInfo
+	}
+	jobs := make(chan job)
+
+	var once sync.Once
+	var first error
+	fail := func(err error) {
+		once.Do(func() {
+			first = err
+			cancel()
+		})
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				if(ctx.Err() != nil) {
+					continue
+				}
+				err := copyEntry(ctx, j.src, j.dst, j.info, progress)
+				if(err != nil) {
+					fail(err)
+				}
+			}
+		}()
+	}
+
+	var dirs []job
+	err := filepath.Walk(src, func(file string, info os.FileInfo, err error) error {
+		if(err != nil) {
+			return err
+		}
+		if(ctx.Err() != nil) {
+			return ctx.Err()
+		}
+		rel, _ := filepath.Rel(src, file)
+		target := filepath.Join(dst, rel)
+
+		if(info.IsDir()) {
+			if(rel != "." && info.Name() == ".snap") {
+				return filepath.SkipDir
+			}
+			err = os.MkdirAll(target, 0700)
+			if(err != nil) {
+				return err
+			}
+			dirs = append(dirs, job{file, target, info})
+			return nil
+		}
+
+		select {
+		case jobs <- job{file, target, info}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		return nil
+	})
+	close(jobs)
+	wg.Wait()
+
+	if(err != nil) {
+		fail(err)
+	}
+	if(first == nil) {
+		// Directory attributes last, copying files changes their times
+		for i := len(dirs)-1; i >= 0; i-- {
+			err = copyAttributes(dirs[i].dst, dirs[i].info)
+			if(err != nil) {
+				fail(err)
+				break
+			}
+		}
+	}
+
+	if(first != nil) {
+		return errors.New(UNABLE_CLONE_VOLUME+first.Error())
+	}
+	return nil
+}
+
+func copyEntry(ctx context.Context, src string, dst string, info os.FileInfo, progress func(int64)) error {
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		link, err := os.Readlink(src)
+		if(err != nil) {
+			return err
+		}
+		os.Remove(dst)
+		err = os.Symlink(link, dst)
+		if(err != nil) {
+			return err
+		}
+		return copyOwner(dst, info)
+	case info.Mode().IsRegular():
+		err := copyFile(ctx, src, dst, progress)
+		if(err != nil) {
+			return err
+		}
+		return copyAttributes(dst, info)
+	}
+	// Devices, sockets and pipes aren't copied
+	return nil
+}
+
+func copyFile(ctx context.Context, src string, dst string, progress func(int64)) error {
+	in, err := os.Open(src)
+	if(err != nil) {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if(err != nil) {
+		return err
+	}
+
+	buf := make([]byte, 1<<20)
+	for {
+		if(ctx.Err() != nil) {
+			out.Close()
+			return ctx.Err()
+		}
+		n, rerr := in.Read(buf)
+		if(n > 0) {
+			_, err = out.Write(buf[:n])
+			if(err != nil) {
+				out.Close()
+				return err
+			}
+			if(progress != nil) {
+				progress(int64(n))
+			}
+		}
+		if(rerr == io.EOF) {
+			break
+		} else if(rerr != nil) {
+			out.Close()
+			return rerr
+		}
+	}
+
+	return out.Close()
+}
+
+func copyAttributes(dst string, info os.FileInfo) error {
+	err := copyOwner(dst, info)
+	if(err != nil) {
+		return err
+	}
+	err = os.Chmod(dst, info.Mode().Perm()|info.Mode()&(os.ModeSetuid|os.ModeSetgid|os.ModeSticky))
+	if(err != nil) {
+		return err
+	}
+	return os.Chtimes(dst, time.Now(), info.ModTime())
+}
+
+func copyOwner(dst string, info os.FileInfo) error {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if(!ok) {
+		return nil
+	}
+	err := os.Lchown(dst, int(stat.Uid), int(stat.Gid))
+	if(os.IsPermission(err)) {
+		// Only root may hand out files, keep the copy owned by us otherwise
+		return nil
+	}
+	return err
+}
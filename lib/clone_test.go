@@ -0,0 +1,92 @@
+package lib
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCloneSource(t *testing.T) {
+	tests := []struct {
+		val			string
+		volume		string
+		snapshot	string
+		valid		bool
+	}{
+		{"prod@nightly", "prod", "nightly", true},
+		{"team@db@daily", "team@db", "daily", true},
+		{"prod", "", "", false},
+		{"@nightly", "", "", false},
+		{"prod@", "", "", false},
+		{"prod@_inherited", "", "", false},
+	}
+
+	for _, test := range tests {
+		volume, snapshot, err := ParseCloneSource(test.val)
+		if(!test.valid) {
+			assert.EqualError(t, err, INVALID_CLONE_SOURCE+test.val)
+			continue
+		}
+		assert.Nil(t, err, test.val)
+		assert.Equal(t, test.volume, volume)
+		assert.Equal(t, test.snapshot, snapshot)
+	}
+}
+
+func TestCopyTree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cephfs-clone")
+	if(err != nil) {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "dst")
+
+	mtime := time.Date(2024, 3, 11, 12, 0, 0, 0, time.UTC)
+	files := map[string]string{
+		"a.txt":         "alpha",
+		"sub/b.txt":     "bravo",
+		"sub/deep/c.db": string(make([]byte, 3<<20)),
+	}
+	for name, content := range files {
+		file := filepath.Join(src, name)
+		assert.Nil(t, os.MkdirAll(filepath.Dir(file), 0755))
+		assert.Nil(t, ioutil.WriteFile(file, []byte(content), 0640))
+		assert.Nil(t, os.Chtimes(file, mtime, mtime))
+	}
+	assert.Nil(t, os.Symlink("sub/b.txt", filepath.Join(src, "link")))
+	assert.Nil(t, os.MkdirAll(filepath.Join(src, "sub", ".snap", "old"), 0755))
+	assert.Nil(t, os.Mkdir(dst, 0755))
+
+	var copied int64
+	err = CopyTree(context.Background(), src, dst, 4, func(n int64) { atomic.AddInt64(&copied, n) })
+
+	assert.Nil(t, err)
+	var total int64
+	for name, content := range files {
+		data, err := ioutil.ReadFile(filepath.Join(dst, name))
+		assert.Nil(t, err)
+		assert.Equal(t, content, string(data))
+		info, err := os.Stat(filepath.Join(dst, name))
+		assert.Nil(t, err)
+		assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+		assert.True(t, mtime.Equal(info.ModTime()))
+		total += int64(len(content))
+	}
+	assert.Equal(t, total, copied)
+	link, err := os.Readlink(filepath.Join(dst, "link"))
+	assert.Nil(t, err)
+	assert.Equal(t, "sub/b.txt", link)
+	assert.False(t, IsDirectory(filepath.Join(dst, "sub", ".snap")))
+
+	// A canceled copy fails
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.NotNil(t, CopyTree(ctx, src, filepath.Join(dir, "canceled"), 2, nil))
+}
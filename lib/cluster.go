@@ -0,0 +1,58 @@
+package lib
+
+import (
+	"context"
+	"strings"
+)
+
+// Cluster holds everything needed to talk to one ceph cluster.
+type Cluster struct {
+	Name		string
+	Monitors	[]string
+	User		string
+	SecretFile	string
+	Keyring		string
+	ConfPath	string
+	Filesystem	string
+}
+
+// Monitor returns the monitors in the comma separated form expected by mount.
+func (c Cluster) Monitor() string {
+	return strings.Join(c.Monitors, ",")
+}
+
+// ID returns the cephx user without the "client." prefix.
+func (c Cluster) ID() string {
+	return strings.TrimPrefix(c.User, "client.")
+}
+
+// Key returns the cephx key of the user from the keyring or the secret file.
+func (c Cluster) Key() (string, error) {
+	if(len(c.Keyring) > 0) {
+		return ReadKey(c.Keyring, c.User)
+	}
+	return ReadKey(c.SecretFile, c.User)
+}
+
+// CephArgs prepends the connection arguments of the cluster to a ceph command.
+func (c Cluster) CephArgs(args ...string) []string {
+	var cargs []string
+	if(len(c.ConfPath) > 0) {
+		cargs = append(cargs, "--conf", c.ConfPath)
+	}
+	if(len(c.Monitors) > 0) {
+		cargs = append(cargs, "--mon-host", c.Monitor())
+	}
+	if(len(c.User) > 0) {
+		cargs = append(cargs, "--id", c.ID())
+	}
+	if(len(c.Keyring) > 0) {
+		cargs = append(cargs, "--keyring", c.Keyring)
+	}
+	return append(cargs, args...)
+}
+
+// Ceph runs a ceph command against the cluster.
+func (c Cluster) Ceph(ctx context.Context, runner CommandRunner, args ...string) (string, error) {
+	return runner.Run(ctx, "ceph", c.CephArgs(args...)...)
+}
@@ -3,10 +3,21 @@ package lib
 import(
 	"fmt"
  	"errors"
+	"strings"
+	"time"
 )
 
 const (
+	UNABLE_READ_CONFIG = "Unable to read config file. Error: "
+	INVALID_CONFIG = "Invalid configuration: "
+
+	UNKNOWN_CLUSTER = "Unknown ceph cluster. Name: "
+
 	REQUIRED_OPTIONS = "You have to specify all required options. (Required options: fsname)"
+	INVALID_MOUNT_TYPE = "Unsupported mount type, use fuse or kernel. Type: "
+	INVALID_VOLUME_NAME = "Volume name doesn't match the configured naming hierarchy. Name: "
+	INVALID_SUBPATH = "Subpath must be a directory below the filesystem root. Subpath: "
+	INVALID_QUOTA = "Quota options must be a number of bytes or files. Value: "
 	MISSING_POOL_OPTION = "You need to specify a Data-/Metapool to create a new Filesystem."
 
 	MISSING_POOL = "One of the given pools doesn't exist."
@@ -15,6 +26,50 @@ const (
 	UNABLE_CREATE_DIR = "Unable to create volume directory. Error: "
 	UNABLE_GET_VOLUMES = "Unable to list all volumes. Error: "
 	UNABLE_FIND_VOLUME = "Unable to find the volume. Name: "
+	UNABLE_MOUNT = "Unable to mount volume. Error: "
+	UNABLE_UNMOUNT = "Unable to unmount volume. Error: "
+	UNABLE_REMOVE_DIR = "Unable to remove volume directory. Error: "
+	UNHEALTHY_MOUNT = "Mount doesn't respond. Path: "
+	UNABLE_READ_MOUNTS = "Unable to read the mount table. Error: "
+	UNABLE_PROBE_ROOT = "Unable to probe the filesystem of the plugin root. Error: "
+	ROOT_NOT_CEPH = "Plugin root isn't on a ceph filesystem. Path: "
+
+	UNABLE_SET_QUOTA = "Unable to set quota "
+	UNABLE_GET_QUOTA = "Unable to read quota "
+
+	UNABLE_READ_SECRET = "Unable to read ceph secret. Error: "
+	INSECURE_SECRET_FILE = "Secret file must only be accessible by its owner. File: "
+	INVALID_SECRET_NAME = "Invalid docker secret name: "
+	MISSING_KEYRING_ENTRY = "Keyring has no key for "
+	UNABLE_AUTHORIZE_CLIENT = "Unable to create ceph client for volume. Error: "
+	UNABLE_REVOKE_CLIENT = "Unable to remove ceph client of volume. Error: "
+	CLIENT_EXISTS = "Ceph client wasn't created by the plugin. Client: "
+	UNABLE_WRITE_KEYRING = "Unable to write keyring of volume. Error: "
+	INVALID_AUTHORIZE = "Option authorize must be true or false. Value: "
+
+	INVALID_SNAPSHOT_NAME = "Invalid snapshot name: "
+	UNABLE_CREATE_SNAPSHOT = "Unable to create snapshot. Error: "
+	UNABLE_DELETE_SNAPSHOT = "Unable to delete snapshot "
+	UNABLE_LIST_SNAPSHOTS = "Unable to list snapshots. Error: "
+	INVALID_SNAPSHOT_RETENTION = "Snapshot retention options must be a number. Value: "
+
+	INVALID_BACKEND = "Unsupported backend, use directory or subvolume. Backend: "
+	SUBPATH_WITH_SUBVOLUME = "The subpath option can't be used with subvolumes."
+	UNABLE_CREATE_SUBVOLUME = "Unable to create subvolume. Error: "
+	UNABLE_RESIZE_SUBVOLUME = "Unable to resize subvolume. Error: "
+	UNABLE_REMOVE_SUBVOLUME = "Unable to remove subvolume. Error: "
+	UNABLE_GET_SUBVOLUME = "Unable to request subvolumes. Error: "
+
+	INVALID_CLONE_SOURCE = "Clone source must be a volume or <volume>@<snapshot>. Value: "
+	UNABLE_CLONE_VOLUME = "Unable to clone volume. Error: "
+	CLONE_SOURCE_IN_USE = "Volume is the source of a running clone. Name: "
+	CLONE_NOT_COMPLETE = "Volume is still being cloned or its clone failed. Name: "
+
+	UNABLE_READ_STATE = "Unable to read driver state. Error: "
+	UNABLE_WRITE_STATE = "Unable to write driver state. Error: "
+
+	VOLUME_IN_USE = "Volume is still mounted by a container. Name: "
+	REMOVE_ROOT_ERROR = "Refusing to remove the filesystem root. Name: "
 
 	VOLUME_NOT_MOUNTED = "Volume isn't mounted. Name: "
 
@@ -22,10 +77,105 @@ const (
 	REQUEST_FILESYSTEM_ERROR = "Unable to request ceph filesystems. Error: "
 	REQUEST_LIST_ERROR = "Unable to request ceph volumes: "
 	PROCESSING_LIST_ERROR = "Unable to convert output from command \"ceph fs ls\"."
+	PROCESSING_DUMP_ERROR = "Unable to convert output from command \"ceph fs dump\"."
 	REQUEST_POOLS_ERROR = "Unable to request ceph pools: "
-	PROCESSING_POOLS_ERROR = "There are no pools."
+	PROCESSING_SUBVOLUME_ERROR = "Unable to convert output from command \"ceph fs subvolume\"."
+	PROCESSING_POOLS_ERROR = "Unable to convert output from command \"ceph osd pool ls\"."
+	MISSING_POOLS_ERROR = "There are no pools."
 )
 
 func InternalError(err error) error {
 	return errors.New(fmt.Sprintf("Internal error(maybe ceph version is not compatible): %s", err.Error()))
-}
\ No newline at end of file
+}
+
+// CommandError describes a failed external command. Args never contain secrets.
+type CommandError struct {
+	Command		string
+	Args		[]string
+	ExitCode	int
+	Stderr		string
+	Elapsed		time.Duration
+	TimedOut	bool
+	Err			error
+}
+
+func (e *CommandError) Error() string {
+	reason := "failed"
+	if(e.TimedOut) {
+		reason = "timed out"
+	}
+
+	msg := fmt.Sprintf("%s %s after %s (exit code %d)",
+						strings.TrimSpace(e.Command+" "+strings.Join(e.Args, " ")),
+						reason, e.Elapsed.Round(time.Millisecond), e.ExitCode)
+	if line := e.Message(); len(line) > 0 {
+		return msg+": "+line
+	} else if(e.Err != nil) {
+		return msg+": "+e.Err.Error()
+	}
+	return msg
+}
+
+// Message returns the most meaningful line of stderr, that is the last line
+// mentioning an error or else the last non empty line.
+func (e *CommandError) Message() string {
+	last := ""
+	lines := strings.Split(e.Stderr, "\n")
+	for i := len(lines)-1; i >= 0; i-- {
+		line := strings.TrimSpace(lines[i])
+		if(len(line) == 0) {
+			continue
+		}
+		if(strings.Contains(strings.ToLower(line), "error")) {
+			return line
+		}
+		if(len(last) == 0) {
+			last = line
+		}
+	}
+	return last
+}
+
+var secretOptions = []string{"secret", "key"}
+
+// RedactOptions hides the values of volume options which may reference secrets.
+func RedactOptions(options map[string]string) map[string]string {
+	redacted := make(map[string]string)
+	for name, value := range options {
+		redacted[name] = value
+		for _, secret := range secretOptions {
+			if(strings.Contains(name, secret)) {
+				redacted[name] = "<redacted>"
+			}
+		}
+	}
+	return redacted
+}
+
+// RedactArgs hides the values of secret=/key= options and of --key/--secret arguments.
+func RedactArgs(args []string) []string {
+	redacted := make([]string, len(args))
+	hideNext := false
+	for i, arg := range args {
+		if(hideNext) {
+			redacted[i] = "<redacted>"
+			hideNext = false
+			continue
+		}
+
+		options := strings.Split(arg, ",")
+		for j, option := range options {
+			for _, name := range secretOptions {
+				if(strings.HasPrefix(option, name+"=")) {
+					options[j] = name+"=<redacted>"
+				} else if(strings.HasPrefix(option, "--"+name+"=")) {
+					options[j] = "--"+name+"=<redacted>"
+				} else if(option == "--"+name) {
+					hideNext = true
+				}
+			}
+		}
+		redacted[i] = strings.Join(options, ",")
+	}
+	return redacted
+}
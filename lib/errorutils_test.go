@@ -0,0 +1,47 @@
+package lib
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedactArgs(t *testing.T) {
+	tests := []struct {
+		args		[]string
+		expected	[]string
+	}{
+		{
+			[]string{"-o", "name=admin,secretfile=/etc/ceph/admin.secret"},
+			[]string{"-o", "name=admin,secretfile=/etc/ceph/admin.secret"},
+		},
+		{
+			[]string{"-o", "name=admin,secret=AQBx==,mds_namespace=cephfs"},
+			[]string{"-o", "name=admin,secret=<redacted>,mds_namespace=cephfs"},
+		},
+		{
+			[]string{"auth", "import", "--key", "AQBx==", "--secret=AQBy=="},
+			[]string{"auth", "import", "--key", "<redacted>", "--secret=<redacted>"},
+		},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, RedactArgs(test.args))
+	}
+}
+
+func TestCommandErrorMessage(t *testing.T) {
+	tests := []struct {
+		stderr		string
+		expected	string
+	}{
+		{"", ""},
+		{"only line\n", "only line"},
+		{"2024 auth: error reading file\nceph-fuse[1]: starting\n", "2024 auth: error reading file"},
+		{"first\nlast\n\n", "last"},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, (&CommandError{Stderr: test.stderr}).Message())
+	}
+}
@@ -0,0 +1,112 @@
+package lib
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+// FakeHandler produces the result of a faked command.
+type FakeHandler func(name string, args ...string) (string, error)
+
+// FakeRunner is a scriptable CommandRunner for tests. It records every call
+// and answers with the handler of the longest matching pattern, unknown
+// commands succeed with empty output. A pattern like "ceph fs ls" matches
+// the command ceph with the arguments "fs ls" anywhere in its argument list,
+// so connection arguments such as --id don't need to be repeated.
+type FakeRunner struct {
+	mutex		sync.Mutex
+	calls		[]string
+	handlers	map[string]FakeHandler
+}
+
+func NewFakeRunner() *FakeRunner {
+	return &FakeRunner{
+		handlers: make(map[string]FakeHandler),
+	}
+}
+
+// On registers canned output for all commands matching pattern, e.g. "ceph fs ls".
+func (f *FakeRunner) On(pattern string, out string, err error) {
+	f.OnFunc(pattern, func(name string, args ...string) (string, error) {
+		return out, err
+	})
+}
+
+// OnFunc registers a handler for all commands matching pattern.
+func (f *FakeRunner) OnFunc(pattern string, handler FakeHandler) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.handlers[pattern] = handler
+}
+
+func (f *FakeRunner) Run(ctx context.Context, name string, args ...string) (string, error) {
+	line := strings.Join(append([]string{name}, args...), " ")
+
+	f.mutex.Lock()
+	f.calls = append(f.calls, line)
+	var handler FakeHandler
+	matched := ""
+	for pattern, h := range f.handlers {
+		if(fakeMatch(pattern, name, args) && len(pattern) >= len(matched)) {
+			handler = h
+			matched = pattern
+		}
+	}
+	f.mutex.Unlock()
+
+	if(ctx.Err() != nil) {
+		return "", ctx.Err()
+	}
+	if(handler == nil) {
+		return "", nil
+	}
+	return handler(name, args...)
+}
+
+func fakeMatch(pattern string, name string, args []string) bool {
+	words := strings.Fields(pattern)
+	if(len(words) == 0 || words[0] != name) {
+		return false
+	}
+	words = words[1:]
+
+	for start := 0; start+len(words) <= len(args); start++ {
+		found := true
+		for i, word := range words {
+			if(args[start+i] != word) {
+				found = false
+				break
+			}
+		}
+		if(found) {
+			return true
+		}
+	}
+	return false
+}
+
+// Calls returns all recorded command lines.
+func (f *FakeRunner) Calls() []string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]string(nil), f.calls...)
+}
+
+// CallsWithPrefix returns the recorded command lines starting with prefix.
+func (f *FakeRunner) CallsWithPrefix(prefix string) []string {
+	var calls []string
+	for _, call := range f.Calls() {
+		if(strings.HasPrefix(call, prefix)) {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+// Reset forgets all recorded calls.
+func (f *FakeRunner) Reset() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.calls = nil
+}
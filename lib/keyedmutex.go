@@ -0,0 +1,71 @@
+package lib
+
+import (
+	"sort"
+	"sync"
+)
+
+// KeyedMutex serializes work on the same keys, e.g. volume names, while
+// work on other keys proceeds in parallel. Unused keys are forgotten.
+type KeyedMutex struct {
+	mutex	sync.Mutex
+	locks	map[string]*keyedLock
+}
+
+type keyedLock struct {
+	sync.Mutex
+	waiting	int
+}
+
+func NewKeyedMutex() *KeyedMutex {
+	return &KeyedMutex{locks: make(map[string]*keyedLock)}
+}
+
+// Lock locks all given keys and returns the function unlocking them. Keys
+// are locked in sorted order, so callers locking several keys can't
+// deadlock each other. Empty and duplicate keys are ignored.
+func (k *KeyedMutex) Lock(keys ...string) func() {
+	var sorted []string
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		if(len(key) > 0 && !seen[key]) {
+			seen[key] = true
+			sorted = append(sorted, key)
+		}
+	}
+	sort.Strings(sorted)
+
+	for _, key := range sorted {
+		k.lock(key)
+	}
+	return func() {
+		for i := len(sorted)-1; i >= 0; i-- {
+			k.unlock(sorted[i])
+		}
+	}
+}
+
+func (k *KeyedMutex) lock(key string) {
+	k.mutex.Lock()
+	l, ok := k.locks[key]
+	if(!ok) {
+		l = &keyedLock{}
+		k.locks[key] = l
+	}
+	l.waiting++
+	k.mutex.Unlock()
+
+	l.Lock()
+}
+
+func (k *KeyedMutex) unlock(key string) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	l := k.locks[key]
+	l.waiting--
+	if(l.waiting == 0) {
+		delete(k.locks, key)
+	}
+	l.Unlock()
+}
@@ -0,0 +1,69 @@
+package lib
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyedMutex(t *testing.T) {
+	k := NewKeyedMutex()
+	a, b := 0, 0
+	counters := map[string]*int{"a": &a, "b": &b}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		for _, key := range []string{"a", "b"} {
+			wg.Add(1)
+			go func(key string) {
+				defer wg.Done()
+				unlock := k.Lock(key)
+				defer unlock()
+				value := *counters[key]
+				time.Sleep(time.Microsecond)
+				*counters[key] = value+1
+			}(key)
+		}
+	}
+	wg.Wait()
+
+	assert.Equal(t, 50, a)
+	assert.Equal(t, 50, b)
+	assert.Empty(t, k.locks)
+}
+
+func TestKeyedMutexSeveralKeys(t *testing.T) {
+	k := NewKeyedMutex()
+
+	// Opposite orders don't deadlock
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			k.Lock("a", "b", "a", "")()
+		}()
+		go func() {
+			defer wg.Done()
+			k.Lock("b", "a")()
+		}()
+	}
+	wg.Wait()
+
+	// Other keys aren't blocked
+	unlock := k.Lock("a")
+	done := make(chan struct{})
+	go func() {
+		k.Lock("c")()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("lock of c blocked by a")
+	}
+	unlock()
+	assert.Empty(t, k.locks)
+}
@@ -0,0 +1,127 @@
+package lib
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// MountInfo is a line of /proc/self/mountinfo.
+type MountInfo struct {
+	ID			int
+	Parent		int
+	Root		string
+	Mountpoint	string
+	FSType		string
+	Source		string
+	Options		string
+}
+
+// ReadMountInfo returns the mounts of the process from a mountinfo file,
+// usually /proc/self/mountinfo.
+func ReadMountInfo(file string) ([]MountInfo, error) {
+	f, err := os.Open(file)
+	if(err != nil) {
+		return nil, errors.New(UNABLE_READ_MOUNTS+err.Error())
+	}
+	defer f.Close()
+
+	return ParseMountInfo(f)
+}
+
+// ParseMountInfo parses the format of /proc/<pid>/mountinfo, see proc(5).
+func ParseMountInfo(r io.Reader) ([]MountInfo, error) {
+	var mounts []MountInfo
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if(len(strings.TrimSpace(line)) == 0) {
+			continue
+		}
+		fields := strings.Fields(line)
+
+		// The optional fields end with a single "-"
+		sep := -1
+		for i := 6; i < len(fields); i++ {
+			if(fields[i] == "-") {
+				sep = i
+				break
+			}
+		}
+		if(len(fields) < 6 || sep < 0 || len(fields) < sep+3) {
+			return nil, errors.New(UNABLE_READ_MOUNTS+"invalid line: "+line)
+		}
+
+		id, err := strconv.Atoi(fields[0])
+		if(err != nil) {
+			return nil, errors.New(UNABLE_READ_MOUNTS+"invalid line: "+line)
+		}
+		parent, err := strconv.Atoi(fields[1])
+		if(err != nil) {
+			return nil, errors.New(UNABLE_READ_MOUNTS+"invalid line: "+line)
+		}
+
+		mount := MountInfo{
+			ID:			id,
+			Parent:		parent,
+			Root:		unescapeMountPath(fields[3]),
+			Mountpoint:	unescapeMountPath(fields[4]),
+			FSType:		fields[sep+1],
+			Source:		unescapeMountPath(fields[sep+2]),
+		}
+		if(len(fields) > sep+3) {
+			mount.Options = fields[sep+3]
+		}
+		mounts = append(mounts, mount)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.New(UNABLE_READ_MOUNTS+err.Error())
+	}
+
+	return mounts, nil
+}
+
+// IsCeph reports whether the mount is a kernel or ceph-fuse mount of CephFS.
+func (m MountInfo) IsCeph() bool {
+	switch m.FSType {
+	case "ceph", "fuse.ceph-fuse":
+		return true
+	case "fuse":
+		// Older ceph-fuse versions only show up in the source
+		return m.Source == "ceph-fuse"
+	}
+	return false
+}
+
+// MountType returns MountTypeKernel or MountTypeFuse for a ceph mount.
+func (m MountInfo) MountType() string {
+	if(m.FSType == "ceph") {
+		return MountTypeKernel
+	}
+	return MountTypeFuse
+}
+
+// unescapeMountPath replaces the octal escapes of spaces, tabs, newlines
+// and backslashes used in mountinfo.
+func unescapeMountPath(val string) string {
+	if(!strings.Contains(val, "\\")) {
+		return val
+	}
+
+	var out strings.Builder
+	for i := 0; i < len(val); i++ {
+		if(val[i] == '\\' && i+3 < len(val)) {
+			if code, err := strconv.ParseUint(val[i+1:i+4], 8, 8); err == nil {
+				out.WriteByte(byte(code))
+				i += 3
+				continue
+			}
+		}
+		out.WriteByte(val[i])
+	}
+	return out.String()
+}
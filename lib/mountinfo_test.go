@@ -0,0 +1,42 @@
+package lib
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMountInfo(t *testing.T) {
+	mounts, err := ParseMountInfo(bytes.NewReader(readSample(t, "mountinfo")))
+
+	assert.Nil(t, err)
+	assert.Len(t, mounts, 7)
+	assert.Equal(t, MountInfo{
+		ID:         102,
+		Parent:     22,
+		Root:       "/volumes/docker/db",
+		Mountpoint: "/var/lib/docker/plugins/_cephfs/mounts/db",
+		FSType:     "ceph",
+		Source:     "10.0.0.1:6789:/volumes/docker/db",
+		Options:    "rw,name=db,secret=<hidden>,mds_namespace=cephfs",
+	}, mounts[3])
+	assert.Equal(t, "/var/lib/docker/plugins/_cephfs/mounts/with space", mounts[5].Mountpoint)
+
+	var ceph []string
+	for _, mount := range mounts {
+		if(mount.IsCeph()) {
+			ceph = append(ceph, mount.Mountpoint)
+		}
+	}
+	assert.Equal(t, []string{
+		"/var/lib/docker/plugins/_cephfs/mounts/web",
+		"/var/lib/docker/plugins/_cephfs/mounts/db",
+		"/var/lib/docker/plugins/_cephfs/manage/default/cephfs",
+		"/var/lib/docker/plugins/_cephfs/mounts/with space",
+	}, ceph)
+
+	_, err = ParseMountInfo(strings.NewReader("22 1 259:2 / / rw shared:1 ext4 /dev/root rw"))
+	assert.NotNil(t, err)
+}
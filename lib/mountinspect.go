@@ -0,0 +1,173 @@
+package lib
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Filesystem types reported by statfs, see statfs(2).
+const (
+	CephSuperMagic	= 0x00c36400
+	FuseSuperMagic	= 0x65735546
+)
+
+// Filesystems reported by Probe.
+const (
+	FileSystemLocal	= "local"
+	FileSystemCeph	= "ceph"
+	FileSystemFuse	= "ceph-fuse"
+)
+
+// MountState describes the ceph mount on a path.
+type MountState struct {
+	Mounted	bool
+	Type	string
+	Source	string
+	Root	string
+	// Stale mounts are listed in the mount table but don't respond
+	Stale	bool
+}
+
+// MountInspector finds ceph mounts through the mount table and statfs.
+type MountInspector struct {
+	MountInfo	string
+	Statfs		func(path string, buf *syscall.Statfs_t) error
+}
+
+// NewMountInspector reads the mount table mountinfo, statfs gives up after
+// timeout.
+func NewMountInspector(mountinfo string, timeout time.Duration) MountInspector {
+	return MountInspector{MountInfo: mountinfo, Statfs: TimeoutStatfs(syscall.Statfs, timeout)}
+}
+
+// TimeoutStatfs returns a statfs which calls statfs in its own goroutine and
+// gives up after timeout with ETIMEDOUT, a hanging MDS can't block the
+// caller this way. The hanging call is left behind until the mount answers.
+func TimeoutStatfs(statfs func(string, *syscall.Statfs_t) error, timeout time.Duration) func(string, *syscall.Statfs_t) error {
+	type result struct {
+		buf	syscall.Statfs_t
+		err	error
+	}
+	return func(path string, buf *syscall.Statfs_t) error {
+		done := make(chan result, 1)
+		go func() {
+			var res result
+			res.err = statfs(path, &res.buf)
+			done <- res
+		}()
+
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case res := <-done:
+			*buf = res.buf
+			return res.err
+		case <-timer.C:
+			return syscall.ETIMEDOUT
+		}
+	}
+}
+
+// Check reports an error if the filesystem on path doesn't respond to
+// statfs, e.g. a mount whose ceph-fuse daemon is gone.
+func (m MountInspector) Check(path string) error {
+	var buf syscall.Statfs_t
+	err := m.Statfs(path, &buf)
+	if(err != nil) {
+		return errors.New(UNHEALTHY_MOUNT+path+": "+err.Error())
+	}
+	return nil
+}
+
+// Mounts returns all entries of the mount table.
+func (m MountInspector) Mounts() ([]MountInfo, error) {
+	return ReadMountInfo(m.MountInfo)
+}
+
+// Inspect reports whether path is the mountpoint of a ceph or ceph-fuse
+// mount. The mount table names the topmost mount on the path, statfs
+// confirms that the filesystem seen on the path is really that mount.
+func (m MountInspector) Inspect(path string) (MountState, error) {
+	mounts, err := m.Mounts()
+	if(err != nil) {
+		return MountState{}, err
+	}
+
+	path = filepath.Clean(path)
+	var top *MountInfo
+	for i := range mounts {
+		// Later entries are mounted on top of earlier ones
+		if(mounts[i].Mountpoint == path) {
+			top = &mounts[i]
+		}
+	}
+	if(top == nil || !top.IsCeph()) {
+		return MountState{}, nil
+	}
+
+	state := MountState{Type: top.MountType(), Source: top.Source, Root: top.Root}
+	var buf syscall.Statfs_t
+	err = m.Statfs(path, &buf)
+	if(err != nil) {
+		state.Stale = true
+		return state, nil
+	}
+
+	magic := uint32(CephSuperMagic)
+	if(state.Type == MountTypeFuse) {
+		magic = FuseSuperMagic
+	}
+	state.Mounted = uint32(buf.Type) == magic
+	return state, nil
+}
+
+// Probe reports whether path is stored on a local filesystem, the ceph
+// kernel client or ceph-fuse. A path which doesn't exist yet is probed at
+// its closest existing parent.
+func (m MountInspector) Probe(path string) (string, error) {
+	path = filepath.Clean(path)
+	var buf syscall.Statfs_t
+	for {
+		err := m.Statfs(path, &buf)
+		if(err == nil) {
+			break
+		}
+		if(err != syscall.ENOENT || path == "/") {
+			return "", &os.PathError{Op: "statfs", Path: path, Err: err}
+		}
+		path = filepath.Dir(path)
+	}
+
+	switch uint32(buf.Type) {
+	case CephSuperMagic:
+		return FileSystemCeph, nil
+	case FuseSuperMagic:
+		// Any fuse filesystem, the mount table tells whether it is ceph-fuse
+		mounts, err := m.Mounts()
+		if(err != nil) {
+			return "", err
+		}
+		var mount *MountInfo
+		for i := range mounts {
+			if(!containsPath(mounts[i].Mountpoint, path)) {
+				continue
+			}
+			if(mount == nil || len(mounts[i].Mountpoint) >= len(mount.Mountpoint)) {
+				mount = &mounts[i]
+			}
+		}
+		if(mount != nil && mount.IsCeph()) {
+			return FileSystemFuse, nil
+		}
+	}
+	return FileSystemLocal, nil
+}
+
+// containsPath reports whether path is dir or lies below it.
+func containsPath(dir string, path string) bool {
+	return dir == "/" || path == dir || strings.HasPrefix(path, dir+"/")
+}
@@ -0,0 +1,144 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func fakeStatfs(types map[string]int64) func(string, *syscall.Statfs_t) error {
+	return func(path string, buf *syscall.Statfs_t) error {
+		fstype, ok := types[path]
+		if(!ok) {
+			return syscall.ENOTCONN
+		}
+		buf.Type = fstype
+		return nil
+	}
+}
+
+func TestInspectMount(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cephfs-mountinfo")
+	if(err != nil) {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "mountinfo")
+	assert.Nil(t, ioutil.WriteFile(file, readSample(t, "mountinfo"), 0600))
+
+	inspector := NewMountInspector(file, time.Second)
+	inspector.Statfs = fakeStatfs(map[string]int64{
+		"/var/lib/docker/plugins/_cephfs/mounts/web": FuseSuperMagic,
+		"/var/lib/docker/plugins/_cephfs/mounts/db":  CephSuperMagic,
+		"/var/lib/docker/plugins/_cephfs/manage/default/cephfs": 0xEF53,
+		"/mnt/other": 0x6969,
+	})
+
+	tests := []struct {
+		path	string
+		state	MountState
+	}{
+		{"/var/lib/docker/plugins/_cephfs/mounts/web/", MountState{Mounted: true, Type: MountTypeFuse, Source: "ceph-fuse", Root: "/"}},
+		{"/var/lib/docker/plugins/_cephfs/mounts/db", MountState{Mounted: true, Type: MountTypeKernel, Source: "10.0.0.1:6789:/volumes/docker/db", Root: "/volumes/docker/db"}},
+		// Listed as ceph-fuse, but statfs shows the directory below
+		{"/var/lib/docker/plugins/_cephfs/manage/default/cephfs", MountState{Type: MountTypeFuse, Source: "ceph-fuse", Root: "/"}},
+		{"/var/lib/docker/plugins/_cephfs/mounts/with space", MountState{Type: MountTypeFuse, Source: "ceph-fuse", Root: "/", Stale: true}},
+		{"/mnt/other", MountState{}},
+		{"/var/lib/docker/plugins/_cephfs/mounts/none", MountState{}},
+	}
+	for _, test := range tests {
+		state, err := inspector.Inspect(test.path)
+		assert.Nil(t, err)
+		assert.Equal(t, test.state, state, test.path)
+	}
+
+	_, err = NewMountInspector(filepath.Join(dir, "missing"), time.Second).Inspect("/")
+	assert.NotNil(t, err)
+}
+
+func TestProbeFileSystem(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cephfs-mountinfo")
+	if(err != nil) {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "mountinfo")
+	assert.Nil(t, ioutil.WriteFile(file, readSample(t, "mountinfo"), 0600))
+
+	inspector := NewMountInspector(file, time.Second)
+	types := map[string]int64{
+		"/": 0xEF53,
+		"/var/lib/docker/plugins/_cephfs/mounts/web": FuseSuperMagic,
+		"/var/lib/docker/plugins/_cephfs/mounts/db/data": CephSuperMagic,
+		"/run/user/1000/gvfs": FuseSuperMagic,
+	}
+	inspector.Statfs = func(path string, buf *syscall.Statfs_t) error {
+		if(path == "/var/lib/docker/plugins/_cephfs/mounts/with space") {
+			return syscall.ENOTCONN
+		}
+		fstype, ok := types[path]
+		if(!ok) {
+			return syscall.ENOENT
+		}
+		buf.Type = fstype
+		return nil
+	}
+
+	tests := []struct {
+		path	string
+		fstype	string
+	}{
+		{"/var/lib/docker/plugins/_cephfs", FileSystemLocal},
+		{"/var/lib/docker/plugins/_cephfs/mounts/web/", FileSystemFuse},
+		// Missing directories are probed at their parent
+		{"/var/lib/docker/plugins/_cephfs/mounts/web/new/dir", FileSystemFuse},
+		{"/var/lib/docker/plugins/_cephfs/mounts/db/data", FileSystemCeph},
+		// Other fuse filesystems are local
+		{"/run/user/1000/gvfs", FileSystemLocal},
+	}
+	for _, test := range tests {
+		fstype, err := inspector.Probe(test.path)
+		assert.Nil(t, err)
+		assert.Equal(t, test.fstype, fstype, test.path)
+	}
+
+	_, err = inspector.Probe("/var/lib/docker/plugins/_cephfs/mounts/with space/dir")
+	assert.NotNil(t, err)
+}
+
+func TestTimeoutStatfs(t *testing.T) {
+	hang := make(chan struct{})
+	defer close(hang)
+	statfs := TimeoutStatfs(func(path string, buf *syscall.Statfs_t) error {
+		if(path == "/mnt/hung") {
+			<-hang
+		}
+		return fakeStatfs(map[string]int64{"/mnt/fuse": FuseSuperMagic})(path, buf)
+	}, 50*time.Millisecond)
+
+	var buf syscall.Statfs_t
+	assert.Nil(t, statfs("/mnt/fuse", &buf))
+	assert.Equal(t, uint32(FuseSuperMagic), uint32(buf.Type))
+	assert.Equal(t, syscall.ENOTCONN, statfs("/mnt/dead", &buf))
+	assert.Equal(t, syscall.ETIMEDOUT, statfs("/mnt/hung", &buf))
+
+	// A mount which doesn't answer in time is stale
+	dir, err := ioutil.TempDir("", "cephfs-mountinfo")
+	if(err != nil) {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "mountinfo")
+	assert.Nil(t, ioutil.WriteFile(file, []byte("100 22 0:50 / /mnt/hung rw - fuse.ceph-fuse ceph-fuse rw\n"), 0600))
+	inspector := MountInspector{MountInfo: file, Statfs: statfs}
+	state, err := inspector.Inspect("/mnt/hung")
+	assert.Nil(t, err)
+	assert.True(t, state.Stale)
+	assert.EqualError(t, inspector.Check("/mnt/hung"), UNHEALTHY_MOUNT+"/mnt/hung: "+syscall.ETIMEDOUT.Error())
+	assert.Nil(t, inspector.Check("/mnt/fuse"))
+}
@@ -0,0 +1,90 @@
+package lib
+
+import (
+	"errors"
+	"path"
+	"strings"
+)
+
+// NormalizeSubpath cleans the subpath of a volume into the absolute form
+// "/team/project/volume". Subpaths climbing up with "..", pointing at the
+// filesystem root or into a snapshot directory are rejected.
+func NormalizeSubpath(subpath string) (string, error) {
+	trimmed := strings.Trim(strings.TrimSpace(subpath), "/")
+	if(len(trimmed) == 0 || strings.ContainsRune(trimmed, 0)) {
+		return "", errors.New(INVALID_SUBPATH+subpath)
+	}
+
+	for _, element := range strings.Split(trimmed, "/") {
+		if(element == ".." || element == ".snap") {
+			return "", errors.New(INVALID_SUBPATH+subpath)
+		}
+	}
+
+	cleaned := path.Clean("/"+trimmed)
+	if(cleaned == "/") {
+		return "", errors.New(INVALID_SUBPATH+subpath)
+	}
+	return cleaned, nil
+}
+
+// Naming maps docker volume names to nested directories. With a separator
+// and a depth above 1 the name "staging.dataio.fileStore" is the directory
+// /staging/dataio/fileStore and only directories at that depth are volumes.
+type Naming struct {
+	Separator	string
+	Depth		int
+}
+
+func (n Naming) nested() bool {
+	return n.Depth > 1 && len(n.Separator) > 0
+}
+
+// Subpath returns the directory of a volume name. Only names which
+// discovery maps back to the same name are accepted, so a flat name must
+// not contain "/" and no part may be "." or padded.
+func (n Naming) Subpath(name string) (string, error) {
+	if(!n.nested()) {
+		if(strings.Contains(name, "/")) {
+			return "", errors.New(INVALID_VOLUME_NAME+name)
+		}
+		return n.checkedSubpath(name, name)
+	}
+
+	parts := strings.Split(name, n.Separator)
+	if(len(parts) != n.Depth) {
+		return "", errors.New(INVALID_VOLUME_NAME+name)
+	}
+	for _, part := range parts {
+		if(len(part) == 0 || part == "." || strings.Contains(part, "/")) {
+			return "", errors.New(INVALID_VOLUME_NAME+name)
+		}
+	}
+	return n.checkedSubpath(name, strings.Join(parts, "/"))
+}
+
+// checkedSubpath normalizes the directory of a name and makes sure the
+// directory gives the name again.
+func (n Naming) checkedSubpath(name string, subpath string) (string, error) {
+	cleaned, err := NormalizeSubpath(subpath)
+	if(err != nil) {
+		return "", err
+	}
+	if(n.Name(cleaned) != name) {
+		return "", errors.New(INVALID_VOLUME_NAME+name)
+	}
+	return cleaned, nil
+}
+
+// Name returns the volume name of a directory.
+func (n Naming) Name(subpath string) string {
+	return strings.Replace(strings.Trim(subpath, "/"), "/", n.Separator, -1)
+}
+
+// Levels returns how deep volumes are nested below the filesystem root.
+func (n Naming) Levels() int {
+	if(!n.nested()) {
+		return 1
+	}
+	return n.Depth
+}
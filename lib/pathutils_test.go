@@ -0,0 +1,81 @@
+package lib
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeSubpath(t *testing.T) {
+	tests := []struct {
+		subpath	string
+		want	string
+	}{
+		{"team", "/team"},
+		{"/team", "/team"},
+		{"team/", "/team"},
+		{" /team ", "/team"},
+		{"staging/dataio/fileStore", "/staging/dataio/fileStore"},
+		{"/staging//dataio/./fileStore/", "/staging/dataio/fileStore"},
+		{"team/.snapshots", "/team/.snapshots"},
+		{"", ""},
+		{"/", ""},
+		{".", ""},
+		{"./.", ""},
+		{"..", ""},
+		{"../..", ""},
+		{"/team/../../etc", ""},
+		{"team/../other", ""},
+		{"team/.snap/nightly", ""},
+		{"team\x00", ""},
+	}
+
+	for _, test := range tests {
+		got, err := NormalizeSubpath(test.subpath)
+		if(len(test.want) == 0) {
+			assert.EqualError(t, err, INVALID_SUBPATH+test.subpath, test.subpath)
+			continue
+		}
+		assert.Nil(t, err, test.subpath)
+		assert.Equal(t, test.want, got, test.subpath)
+	}
+}
+
+func TestNaming(t *testing.T) {
+	tests := []struct {
+		naming	Naming
+		name	string
+		subpath	string
+	}{
+		{Naming{}, "fileStore", "/fileStore"},
+		{Naming{Depth: 1}, "staging.fileStore", "/staging.fileStore"},
+		{Naming{Separator: ".", Depth: 1}, "staging.fileStore", "/staging.fileStore"},
+		{Naming{Separator: ".", Depth: 3}, "staging.dataio.fileStore", "/staging/dataio/fileStore"},
+		{Naming{Separator: "--", Depth: 2}, "dataio--file.store", "/dataio/file.store"},
+		{Naming{Separator: ".", Depth: 3}, "dataio.fileStore", ""},
+		{Naming{Separator: ".", Depth: 3}, "a.b.c.d", ""},
+		{Naming{Separator: ".", Depth: 3}, "staging..fileStore", ""},
+		{Naming{Separator: ".", Depth: 2}, "staging/x.y", ""},
+		{Naming{Separator: ".", Depth: 2}, "staging..", ""},
+		{Naming{Separator: "-", Depth: 2}, "staging-.", ""},
+		{Naming{Separator: "-", Depth: 2}, " staging-x", ""},
+		{Naming{}, "staging/fileStore", ""},
+		{Naming{Separator: ".", Depth: 1}, "staging/fileStore", ""},
+		{Naming{}, "fileStore/", ""},
+		{Naming{}, " fileStore", ""},
+	}
+
+	for _, test := range tests {
+		subpath, err := test.naming.Subpath(test.name)
+		if(len(test.subpath) == 0) {
+			assert.EqualError(t, err, INVALID_VOLUME_NAME+test.name, test.name)
+			continue
+		}
+		assert.Nil(t, err, test.name)
+		assert.Equal(t, test.subpath, subpath, test.name)
+		// Discovery finds the volume under the same name
+		assert.Equal(t, test.name, test.naming.Name(subpath), test.name)
+		assert.Len(t, strings.Split(strings.Trim(subpath, "/"), "/"), test.naming.Levels(), test.name)
+	}
+}
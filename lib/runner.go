@@ -0,0 +1,24 @@
+package lib
+
+import (
+	"context"
+	"time"
+)
+
+// CommandRunner executes the external commands (ceph, mount, umount, ...) used by the driver.
+type CommandRunner interface {
+	Run(ctx context.Context, name string, args ...string) (string, error)
+}
+
+// ShellRunner runs commands on the host and gives up after Timeout.
+type ShellRunner struct {
+	Timeout	time.Duration
+}
+
+func NewShellRunner() ShellRunner {
+	return ShellRunner{Timeout: defaultShellTimeout}
+}
+
+func (r ShellRunner) Run(ctx context.Context, name string, args ...string) (string, error) {
+	return ShWithTimeout(ctx, r.Timeout, name, args...)
+}
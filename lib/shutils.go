@@ -2,10 +2,12 @@ package lib
 
 import (
 	"github.com/Sirupsen/logrus"
+	"bytes"
+	"context"
 	"time"
 	"os/exec"
 	"strings"
-	"errors"
+	"syscall"
 )
 
 
@@ -13,50 +15,73 @@ var (
 	defaultShellTimeout = 2 * 60 * time.Second
 )
 
-// sh is a simple os.exec Command tool, returns trimmed string output
-func Sh(name string, args ...string) (string, error) {
-	cmd := exec.Command(name, args...)
-
-	out, err := cmd.Output()
-	return strings.Trim(string(out), " \n"), err
-}
-
-// ShResult used for channel in timeout
-type ShResult struct {
-	Output string // STDOUT
-	Err    error  // go error, not STDERR
-}
-
+// sh runs the command in its own process group, returns trimmed string output.
+// The whole process group is killed once the context is done.
+func Sh(ctx context.Context, name string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
 
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	start := time.Now()
+	err := cmd.Start()
+	if(err != nil) {
+		return "", &CommandError{Command: name, Args: RedactArgs(args), ExitCode: -1, Err: err}
+	}
 
+	waitChan := make(chan error, 1)
+	go func() {
+		waitChan <- cmd.Wait()
+	}()
 
-// shWithTimeout will run the Cmd and wait for the specified duration
-func ShWithTimeout(howLong time.Duration, name string, args ...string) (string, error) {
+	timedOut := false
+	select {
+	case err = <-waitChan:
+	case <-ctx.Done():
+		// kill the process group, not only the direct child
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		err = <-waitChan
+		timedOut = true
+	}
 
-	// set up the results channel
-	resultsChan := make(chan ShResult, 1)
+	out := strings.Trim(stdout.String(), " \n")
+	if(err == nil) {
+		return out, nil
+	}
 
-	logrus.Debugf("volume-rbd Message=shWithTimeout(%v, %s, %v)", howLong, name, args)
+	exitCode := -1
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		exitCode = exitErr.ExitCode()
+	}
+	if(timedOut) {
+		err = ctx.Err()
+	}
 
+	return out, &CommandError{
+		Command:  name,
+		Args:     RedactArgs(args),
+		ExitCode: exitCode,
+		Stderr:   strings.TrimSpace(stderr.String()),
+		Elapsed:  time.Since(start),
+		TimedOut: timedOut,
+		Err:      err,
+	}
+}
 
-	// fire up the goroutine for the actual shell command
-	go func() {
-		out, err := Sh(name, args...)
-		resultsChan <- ShResult{Output: out, Err: err}
-	}()
+// shWithTimeout will run the Cmd and kill it after the specified duration
+func ShWithTimeout(ctx context.Context, howLong time.Duration, name string, args ...string) (string, error) {
+	logrus.Debugf("volume-cephfs Message=shWithTimeout(%v, %s, %v)", howLong, name, RedactArgs(args))
 
-	select {
-	case res := <-resultsChan:
-		return res.Output, res.Err
-	case <-time.After(howLong):
-		return "", errors.New("timeout reached")
-	}
+	ctx, cancel := context.WithTimeout(ctx, howLong)
+	defer cancel()
 
-	return "", nil
+	return Sh(ctx, name, args...)
 }
 
 
 // shWithDefaultTimeout will use the defaultShellTimeout so you dont have to pass one
-func ShWithDefaultTimeout(name string, args ...string) (string, error) {
-	return ShWithTimeout(defaultShellTimeout, name, args...)
-}
\ No newline at end of file
+func ShWithDefaultTimeout(ctx context.Context, name string, args ...string) (string, error) {
+	return ShWithTimeout(ctx, defaultShellTimeout, name, args...)
+}
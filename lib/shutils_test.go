@@ -0,0 +1,46 @@
+package lib
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShOutput(t *testing.T) {
+	out, err := ShWithDefaultTimeout(context.Background(), "sh", "-c", "echo hello")
+
+	assert.Nil(t, err)
+	assert.Equal(t, "hello", out)
+}
+
+func TestShError(t *testing.T) {
+	_, err := ShWithDefaultTimeout(context.Background(), "sh", "-c", "echo oops >&2; exit 3")
+
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "exit code 3")
+	assert.Contains(t, err.Error(), "oops")
+}
+
+func TestShTimeoutKillsProcessGroup(t *testing.T) {
+	start := time.Now()
+	_, err := ShWithTimeout(context.Background(), 100*time.Millisecond, "sh", "-c", "sleep 10 & sleep 10")
+
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "timed out")
+	// the background sleep holds stdout open, so this only returns early
+	// if the whole process group was killed
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
+
+func TestShErrorType(t *testing.T) {
+	_, err := ShWithDefaultTimeout(context.Background(), "sh", "-c", "echo progress >&2; echo 'mount error 13 = Permission denied' >&2; echo done >&2; exit 32", "secret=AQBx")
+
+	cmdErr, ok := err.(*CommandError)
+	assert.True(t, ok)
+	assert.Equal(t, "sh", cmdErr.Command)
+	assert.Equal(t, 32, cmdErr.ExitCode)
+	assert.Equal(t, "mount error 13 = Permission denied", cmdErr.Message())
+	assert.NotContains(t, err.Error(), "AQBx")
+}
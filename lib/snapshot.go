@@ -0,0 +1,163 @@
+package lib
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	XATTR_SNAP_BTIME = "ceph.snap.btime"
+
+	// Prefix of snapshots taken by the schedule, only these are pruned.
+	ScheduledSnapshotPrefix = "scheduled-"
+)
+
+type Snapshot struct {
+	Name	string
+	Created	time.Time
+}
+
+// SnapshotDir returns the .snap directory of a volume on a mounted filesystem root.
+func SnapshotDir(root string, subpath string) string {
+	return filepath.Join(root, subpath, ".snap")
+}
+
+// ValidSnapshotName reports whether name can be used as snapshot directory.
+func ValidSnapshotName(name string) bool {
+	return len(name) > 0 && name != "." && name != ".." &&
+		!strings.HasPrefix(name, "_") && !strings.ContainsAny(name, "/\x00")
+}
+
+// CreateSnapshot takes a snapshot of the volume at subpath below the mounted root.
+func CreateSnapshot(root string, subpath string, name string) error {
+	if(!ValidSnapshotName(name)) {
+		return errors.New(INVALID_SNAPSHOT_NAME+name)
+	}
+	err := os.Mkdir(filepath.Join(SnapshotDir(root, subpath), name), 0755)
+	if(err != nil) {
+		return errors.New(UNABLE_CREATE_SNAPSHOT+err.Error())
+	}
+	return nil
+}
+
+// DeleteSnapshot removes a snapshot of the volume at subpath below the mounted root.
+func DeleteSnapshot(root string, subpath string, name string) error {
+	if(!ValidSnapshotName(name)) {
+		return errors.New(INVALID_SNAPSHOT_NAME+name)
+	}
+	err := syscall.Rmdir(filepath.Join(SnapshotDir(root, subpath), name))
+	if(err != nil) {
+		return errors.New(UNABLE_DELETE_SNAPSHOT+name+": "+err.Error())
+	}
+	return nil
+}
+
+// ListSnapshots returns the snapshots of the volume at subpath below the
+// mounted root, oldest first. Snapshots of parent directories are skipped.
+func ListSnapshots(root string, subpath string) ([]Snapshot, error) {
+	dir := SnapshotDir(root, subpath)
+	infos, err := ioutil.ReadDir(dir)
+	if(err != nil) {
+		return nil, errors.New(UNABLE_LIST_SNAPSHOTS+err.Error())
+	}
+
+	var snaps []Snapshot
+	for _, info := range infos {
+		// Inherited snapshots of parents show up as _name_inode
+		if(!info.IsDir() || strings.HasPrefix(info.Name(), "_")) {
+			continue
+		}
+		snaps = append(snaps, Snapshot{
+			Name:    info.Name(),
+			Created: snapshotBirthTime(filepath.Join(dir, info.Name()), info.ModTime()),
+		})
+	}
+	sort.Slice(snaps, func(i, j int) bool {
+		return snaps[i].Created.Before(snaps[j].Created)
+	})
+
+	return snaps, nil
+}
+
+// snapshotBirthTime reads ceph.snap.btime ("<sec>.<nsec>"), falling back
+// to the modification time on clusters which don't provide it.
+func snapshotBirthTime(path string, fallback time.Time) time.Time {
+	buf := make([]byte, 64)
+	n, err := syscall.Getxattr(path, XATTR_SNAP_BTIME, buf)
+	if(err != nil) {
+		return fallback
+	}
+
+	parts := strings.SplitN(strings.Trim(string(buf[:n]), " \n\x00"), ".", 2)
+	sec, err := strconv.ParseInt(parts[0], 10, 64)
+	if(err != nil) {
+		return fallback
+	}
+	var nsec int64
+	if(len(parts) == 2) {
+		nsec, _ = strconv.ParseInt(parts[1], 10, 64)
+	}
+	return time.Unix(sec, nsec)
+}
+
+// ScheduledSnapshotName names a snapshot taken by the schedule at t.
+func ScheduledSnapshotName(t time.Time) string {
+	return ScheduledSnapshotPrefix+t.UTC().Format("20060102T150405Z")
+}
+
+// scheduledTime returns the time a scheduled snapshot was taken for, which is
+// part of its name, or its creation time.
+func scheduledTime(snap Snapshot) time.Time {
+	t, err := time.Parse("20060102T150405Z", strings.TrimPrefix(snap.Name, ScheduledSnapshotPrefix))
+	if(err != nil) {
+		return snap.Created
+	}
+	return t
+}
+
+// ExpiredSnapshots returns the scheduled snapshots which are neither the
+// newest of one of the last keepHourly hours nor of the last keepDaily days.
+func ExpiredSnapshots(snaps []Snapshot, keepHourly int, keepDaily int) []Snapshot {
+	var scheduled []Snapshot
+	for _, snap := range snaps {
+		if(strings.HasPrefix(snap.Name, ScheduledSnapshotPrefix)) {
+			scheduled = append(scheduled, snap)
+		}
+	}
+	// newest first
+	sort.Slice(scheduled, func(i, j int) bool {
+		return scheduledTime(scheduled[i]).After(scheduledTime(scheduled[j]))
+	})
+
+	keep := make(map[string]bool)
+	keepNewest := func(count int, bucket func(time.Time) string) {
+		seen := make(map[string]bool)
+		for _, snap := range scheduled {
+			if(len(seen) >= count) {
+				return
+			}
+			b := bucket(scheduledTime(snap))
+			if(!seen[b]) {
+				seen[b] = true
+				keep[snap.Name] = true
+			}
+		}
+	}
+	keepNewest(keepHourly, func(t time.Time) string { return t.UTC().Format("2006010215") })
+	keepNewest(keepDaily, func(t time.Time) string { return t.UTC().Format("20060102") })
+
+	var expired []Snapshot
+	for _, snap := range scheduled {
+		if(!keep[snap.Name]) {
+			expired = append(expired, snap)
+		}
+	}
+	return expired
+}
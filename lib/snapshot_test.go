@@ -0,0 +1,72 @@
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshotLifecycle(t *testing.T) {
+	root, err := ioutil.TempDir("", "cephfs-snap")
+	if(err != nil) {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	// a plain directory stands in for the .snap directory of CephFS
+	assert.Nil(t, os.MkdirAll(filepath.Join(root, "team", ".snap", "_parent_1099511627776"), 0755))
+
+	assert.Nil(t, CreateSnapshot(root, "/team", "first"))
+	assert.Nil(t, CreateSnapshot(root, "/team", "second"))
+	assert.NotNil(t, CreateSnapshot(root, "/team", "../escape"))
+	assert.NotNil(t, CreateSnapshot(root, "/team", "first"))
+
+	snaps, err := ListSnapshots(root, "/team")
+	assert.Nil(t, err)
+	var names []string
+	for _, snap := range snaps {
+		names = append(names, snap.Name)
+		assert.False(t, snap.Created.IsZero())
+	}
+	assert.ElementsMatch(t, []string{"first", "second"}, names)
+
+	assert.Nil(t, DeleteSnapshot(root, "/team", "first"))
+	assert.NotNil(t, DeleteSnapshot(root, "/team", "first"))
+	snaps, err = ListSnapshots(root, "/team")
+	assert.Nil(t, err)
+	assert.Len(t, snaps, 1)
+}
+
+func TestExpiredSnapshots(t *testing.T) {
+	now := time.Date(2024, 3, 11, 12, 30, 0, 0, time.UTC)
+	var snaps []Snapshot
+	// hourly snapshots over the last three days plus a manual one
+	for i := 0; i < 72; i++ {
+		created := now.Add(-time.Duration(i) * time.Hour)
+		snaps = append(snaps, Snapshot{Name: ScheduledSnapshotName(created), Created: created})
+	}
+	snaps = append(snaps, Snapshot{Name: "manual", Created: now.Add(-100 * time.Hour)})
+
+	expired := ExpiredSnapshots(snaps, 6, 3)
+
+	kept := make(map[string]bool)
+	for _, snap := range snaps {
+		kept[snap.Name] = true
+	}
+	for _, snap := range expired {
+		delete(kept, snap.Name)
+	}
+	assert.True(t, kept["manual"])
+	// 6 hourly ones, the newest of today is one of them, plus the newest of the two days before
+	assert.Len(t, kept, 6+2+1)
+	assert.True(t, kept[ScheduledSnapshotName(now)])
+	assert.True(t, kept[ScheduledSnapshotName(time.Date(2024, 3, 10, 23, 30, 0, 0, time.UTC))])
+	assert.True(t, kept[ScheduledSnapshotName(time.Date(2024, 3, 9, 23, 30, 0, 0, time.UTC))])
+	assert.False(t, kept[ScheduledSnapshotName(now.Add(-6 * time.Hour))])
+
+	assert.Empty(t, ExpiredSnapshots(snaps[:3], 6, 0))
+	assert.Len(t, ExpiredSnapshots(snaps[:3], 0, 0), 3)
+}
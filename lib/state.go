@@ -0,0 +1,67 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// VolumeState is the persisted form of a volume known to the driver.
+type VolumeState struct {
+	Volume		Volume		`json:"volume"`
+	MountIDs	[]string	`json:"mount_ids"`
+	Clone		*Clone		`json:"clone,omitempty"`
+}
+
+// State is the content of the driver state file.
+type State struct {
+	Volumes		[]VolumeState	`json:"volumes"`
+}
+
+// LoadState reads the state file, a missing file yields an empty state.
+func LoadState(file string) (*State, error) {
+	state := &State{}
+
+	data, err := ioutil.ReadFile(file)
+	if(os.IsNotExist(err)) {
+		return state, nil
+	} else if(err != nil) {
+		return nil, errors.New(UNABLE_READ_STATE+err.Error())
+	}
+
+	err = json.Unmarshal(data, state)
+	if(err != nil) {
+		return nil, errors.New(UNABLE_READ_STATE+err.Error())
+	}
+
+	return state, nil
+}
+
+// Save writes the state atomically by renaming a temporary file.
+func (s *State) Save(file string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if(err != nil) {
+		return errors.New(UNABLE_WRITE_STATE+err.Error())
+	}
+
+	err = os.MkdirAll(filepath.Dir(file), os.ModePerm)
+	if(err != nil) {
+		return errors.New(UNABLE_WRITE_STATE+err.Error())
+	}
+
+	tmp := file+".tmp"
+	err = ioutil.WriteFile(tmp, data, 0600)
+	if(err != nil) {
+		return errors.New(UNABLE_WRITE_STATE+err.Error())
+	}
+
+	err = os.Rename(tmp, file)
+	if(err != nil) {
+		os.Remove(tmp)
+		return errors.New(UNABLE_WRITE_STATE+err.Error())
+	}
+
+	return nil
+}
@@ -0,0 +1,357 @@
+package lib
+
+import (
+	"github.com/Sirupsen/logrus"
+
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	BackendDirectory	= "directory"
+	BackendSubvolume	= "subvolume"
+
+	// SubvolumeRoot is the directory of the filesystem holding all subvolumes.
+	SubvolumeRoot = "volumes"
+)
+
+// Subvolume is a CephFS subvolume as reported by "ceph fs subvolume info".
+type Subvolume struct {
+	Name		string
+	Group		string
+	Path		string
+	DataPool	string
+	Quota		Quota
+}
+
+// cephSubvolumeInfo is the part of "ceph fs subvolume info" needed by the driver.
+// bytes_quota is a number or "infinite".
+type cephSubvolumeInfo struct {
+	Path		string		`json:"path"`
+	BytesQuota	interface{}	`json:"bytes_quota"`
+	BytesUsed	uint64		`json:"bytes_used"`
+	DataPool	string		`json:"data_pool"`
+}
+
+// cephNameEntry is one element of "ceph fs subvolume ls" and "ceph fs subvolume snapshot ls".
+type cephNameEntry struct {
+	Name	string	`json:"name"`
+}
+
+type cephSnapshotInfo struct {
+	CreatedAt	string	`json:"created_at"`
+}
+
+type cephCloneStatus struct {
+	Status	struct {
+		State			string	`json:"state"`
+		Failure			struct {
+			Errno		string	`json:"errno"`
+			Message		string	`json:"error_msg"`
+		}	`json:"failure"`
+		ProgressReport	struct {
+			Percentage	string	`json:"percentage cloned"`
+		}	`json:"progress_report"`
+	}	`json:"status"`
+}
+
+// groupArgs appends the subvolume group to a ceph fs subvolume command.
+func groupArgs(group string, args ...string) []string {
+	if(len(group) > 0) {
+		args = append(args, "--group_name", group)
+	}
+	return args
+}
+
+// cephNotFound reports whether a ceph command failed with ENOENT.
+func cephNotFound(err error) bool {
+	cerr, ok := err.(*CommandError)
+	return ok && cerr.ExitCode == 2
+}
+
+// CreateSubvolumeGroup creates the group if it doesn't exist yet.
+func CreateSubvolumeGroup(ctx context.Context, runner CommandRunner, cluster Cluster, fsname string, group string) error {
+	out, err := cluster.Ceph(ctx, runner, "fs", "subvolumegroup", "create", fsname, group)
+	if(err != nil) {
+		return errors.New(UNABLE_CREATE_SUBVOLUME+err.Error())
+	}
+	logrus.Debug(out)
+	return nil
+}
+
+// CreateSubvolume creates a subvolume with a quota of size bytes, 0 means
+// no quota, and an optional data pool.
+func CreateSubvolume(ctx context.Context, runner CommandRunner, cluster Cluster, fsname string, group string, name string, size uint64, pool string) error {
+	args := []string{"fs", "subvolume", "create", fsname, name}
+	if(size > 0) {
+		args = append(args, "--size", strconv.FormatUint(size, 10))
+	}
+	if(len(pool) > 0) {
+		args = append(args, "--pool_layout", pool)
+	}
+	out, err := cluster.Ceph(ctx, runner, groupArgs(group, args...)...)
+	if(err != nil) {
+		return errors.New(UNABLE_CREATE_SUBVOLUME+err.Error())
+	}
+	logrus.Debug(out)
+	return nil
+}
+
+// ResizeSubvolume changes the quota of a subvolume, 0 removes it.
+func ResizeSubvolume(ctx context.Context, runner CommandRunner, cluster Cluster, fsname string, group string, name string, size uint64) error {
+	newSize := "infinite"
+	if(size > 0) {
+		newSize = strconv.FormatUint(size, 10)
+	}
+	out, err := cluster.Ceph(ctx, runner, groupArgs(group, "fs", "subvolume", "resize", fsname, name, newSize)...)
+	if(err != nil) {
+		return errors.New(UNABLE_RESIZE_SUBVOLUME+err.Error())
+	}
+	logrus.Debug(out)
+	return nil
+}
+
+// RemoveSubvolume moves a subvolume to the trash of the filesystem, a
+// missing subvolume isn't an error.
+func RemoveSubvolume(ctx context.Context, runner CommandRunner, cluster Cluster, fsname string, group string, name string) error {
+	out, err := cluster.Ceph(ctx, runner, groupArgs(group, "fs", "subvolume", "rm", fsname, name, "--force")...)
+	if(err != nil) {
+		return errors.New(UNABLE_REMOVE_SUBVOLUME+err.Error())
+	}
+	logrus.Debug(out)
+	return nil
+}
+
+// GetSubvolume returns the path, quota and usage of a subvolume, nil if it doesn't exist.
+func GetSubvolume(ctx context.Context, runner CommandRunner, cluster Cluster, fsname string, group string, name string) (*Subvolume, error) {
+	out, err := cluster.Ceph(ctx, runner, groupArgs(group, "fs", "subvolume", "info", fsname, name, "--format", "json")...)
+	if(cephNotFound(err)) {
+		return nil, nil
+	} else if(err != nil) {
+		return nil, errors.New(UNABLE_GET_SUBVOLUME+err.Error())
+	}
+
+	sub, err := parseSubvolumeInfo([]byte(out))
+	if(err != nil) {
+		return nil, err
+	}
+	sub.Name = name
+	sub.Group = group
+	return sub, nil
+}
+
+func parseSubvolumeInfo(data []byte) (*Subvolume, error) {
+	var info cephSubvolumeInfo
+	err := json.Unmarshal(data, &info)
+	if(err != nil) {
+		return nil, InternalError(errors.New(PROCESSING_SUBVOLUME_ERROR+" "+err.Error()))
+	}
+
+	sub := &Subvolume{
+		Path:     info.Path,
+		DataPool: info.DataPool,
+		Quota:    Quota{Bytes: info.BytesUsed},
+	}
+	if quota, ok := info.BytesQuota.(float64); ok {
+		sub.Quota.MaxBytes = uint64(quota)
+	}
+	return sub, nil
+}
+
+// ListSubvolumes returns the names of all subvolumes of the group, a missing group has none.
+func ListSubvolumes(ctx context.Context, runner CommandRunner, cluster Cluster, fsname string, group string) ([]string, error) {
+	args := []string{"fs", "subvolume", "ls", fsname}
+	if(len(group) > 0) {
+		args = append(args, group)
+	}
+	out, err := cluster.Ceph(ctx, runner, append(args, "--format", "json")...)
+	if(cephNotFound(err)) {
+		return nil, nil
+	} else if(err != nil) {
+		return nil, errors.New(UNABLE_GET_SUBVOLUME+err.Error())
+	}
+
+	return parseNames([]byte(out))
+}
+
+func parseNames(data []byte) ([]string, error) {
+	var entries []cephNameEntry
+	err := json.Unmarshal(data, &entries)
+	if(err != nil) {
+		return nil, InternalError(errors.New(PROCESSING_SUBVOLUME_ERROR+" "+err.Error()))
+	}
+
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name)
+	}
+	return names, nil
+}
+
+// GetSubvolumes returns the subvolumes of the group in all filesystems of the cluster as volumes.
+func GetSubvolumes(ctx context.Context, runner CommandRunner, cluster Cluster, group string, mountType string) (VolumeList, error) {
+	var vols VolumeList
+
+	fss, err := GetCephFilesystems(ctx, runner, cluster, "")
+	if(err != nil) {
+		return nil, err
+	}
+
+	for _, fs := range fss {
+		names, err := ListSubvolumes(ctx, runner, cluster, fs.Name, group)
+		if(err != nil) {
+			return nil, err
+		}
+		for _, name := range names {
+			sub, err := GetSubvolume(ctx, runner, cluster, fs.Name, group, name)
+			if(err != nil) {
+				return nil, err
+			} else if(sub == nil) {
+				// Removed in the meantime
+				continue
+			}
+			vols = append(vols, Volume{
+				Name: name,
+				Subpath: sub.Path,
+				SubvolumeGroup: group,
+				Cluster: cluster.Name,
+				Filesystem: fs,
+				MountType: mountType,
+				Quota: sub.Quota,
+			})
+		}
+	}
+
+	return vols, nil
+}
+
+// CreateSubvolumeSnapshot takes a snapshot of a subvolume.
+func CreateSubvolumeSnapshot(ctx context.Context, runner CommandRunner, cluster Cluster, fsname string, group string, name string, snapshot string) error {
+	if(!ValidSnapshotName(snapshot)) {
+		return errors.New(INVALID_SNAPSHOT_NAME+snapshot)
+	}
+	out, err := cluster.Ceph(ctx, runner, groupArgs(group, "fs", "subvolume", "snapshot", "create", fsname, name, snapshot)...)
+	if(err != nil) {
+		return errors.New(UNABLE_CREATE_SNAPSHOT+err.Error())
+	}
+	logrus.Debug(out)
+	return nil
+}
+
+// RemoveSubvolumeSnapshot deletes a snapshot of a subvolume.
+func RemoveSubvolumeSnapshot(ctx context.Context, runner CommandRunner, cluster Cluster, fsname string, group string, name string, snapshot string) error {
+	if(!ValidSnapshotName(snapshot)) {
+		return errors.New(INVALID_SNAPSHOT_NAME+snapshot)
+	}
+	out, err := cluster.Ceph(ctx, runner, groupArgs(group, "fs", "subvolume", "snapshot", "rm", fsname, name, snapshot)...)
+	if(err != nil) {
+		return errors.New(UNABLE_DELETE_SNAPSHOT+snapshot+": "+err.Error())
+	}
+	logrus.Debug(out)
+	return nil
+}
+
+// ListSubvolumeSnapshots returns the snapshots of a subvolume, oldest first.
+func ListSubvolumeSnapshots(ctx context.Context, runner CommandRunner, cluster Cluster, fsname string, group string, name string) ([]Snapshot, error) {
+	out, err := cluster.Ceph(ctx, runner, groupArgs(group, "fs", "subvolume", "snapshot", "ls", fsname, name, "--format", "json")...)
+	if(err != nil) {
+		return nil, errors.New(UNABLE_LIST_SNAPSHOTS+err.Error())
+	}
+	names, err := parseNames([]byte(out))
+	if(err != nil) {
+		return nil, err
+	}
+
+	var snaps []Snapshot
+	for _, snapshot := range names {
+		out, err := cluster.Ceph(ctx, runner, groupArgs(group, "fs", "subvolume", "snapshot", "info", fsname, name, snapshot, "--format", "json")...)
+		if(err != nil) {
+			return nil, errors.New(UNABLE_LIST_SNAPSHOTS+err.Error())
+		}
+		created, err := parseSnapshotCreated([]byte(out))
+		if(err != nil) {
+			return nil, err
+		}
+		snaps = append(snaps, Snapshot{Name: snapshot, Created: created})
+	}
+	sort.Slice(snaps, func(i, j int) bool {
+		return snaps[i].Created.Before(snaps[j].Created)
+	})
+
+	return snaps, nil
+}
+
+// parseSnapshotCreated reads created_at of "ceph fs subvolume snapshot info",
+// e.g. "2024-03-11 12:30:00.123456" in UTC.
+func parseSnapshotCreated(data []byte) (time.Time, error) {
+	var info cephSnapshotInfo
+	err := json.Unmarshal(data, &info)
+	if(err != nil) {
+		return time.Time{}, InternalError(errors.New(PROCESSING_SUBVOLUME_ERROR+" "+err.Error()))
+	}
+	created, err := time.Parse("2006-01-02 15:04:05.999999", info.CreatedAt)
+	if(err != nil) {
+		return time.Time{}, InternalError(errors.New(PROCESSING_SUBVOLUME_ERROR+" "+err.Error()))
+	}
+	return created, nil
+}
+
+// CloneSubvolumeSnapshot starts a server side clone of a snapshot into a new
+// subvolume of the same group.
+func CloneSubvolumeSnapshot(ctx context.Context, runner CommandRunner, cluster Cluster, fsname string, group string, name string, snapshot string, target string) error {
+	args := groupArgs(group, "fs", "subvolume", "snapshot", "clone", fsname, name, snapshot, target)
+	if(len(group) > 0) {
+		args = append(args, "--target_group_name", group)
+	}
+	out, err := cluster.Ceph(ctx, runner, args...)
+	if(err != nil) {
+		return errors.New(UNABLE_CLONE_VOLUME+err.Error())
+	}
+	logrus.Debug(out)
+	return nil
+}
+
+// SubvolumeCloneStatus returns the state of a server side clone, its
+// progress in percent if reported and the reason of a failure.
+func SubvolumeCloneStatus(ctx context.Context, runner CommandRunner, cluster Cluster, fsname string, group string, target string) (Clone, error) {
+	out, err := cluster.Ceph(ctx, runner, groupArgs(group, "fs", "clone", "status", fsname, target, "--format", "json")...)
+	if(err != nil) {
+		return Clone{}, errors.New(UNABLE_CLONE_VOLUME+err.Error())
+	}
+	return parseCloneStatus([]byte(out))
+}
+
+func parseCloneStatus(data []byte) (Clone, error) {
+	var status cephCloneStatus
+	err := json.Unmarshal(data, &status)
+	if(err != nil) {
+		return Clone{}, InternalError(errors.New(PROCESSING_SUBVOLUME_ERROR+" "+err.Error()))
+	}
+
+	clone := Clone{Progress: status.Status.ProgressReport.Percentage}
+	switch status.Status.State {
+	case "pending", "in-progress":
+		clone.State = CloneCopying
+	case "complete":
+		clone.State = CloneComplete
+	default:
+		clone.State = CloneFailed
+		clone.Error = strings.TrimSpace(status.Status.State+": "+status.Status.Failure.Message)
+	}
+	return clone, nil
+}
+
+// CancelSubvolumeClone stops a pending or running server side clone.
+func CancelSubvolumeClone(ctx context.Context, runner CommandRunner, cluster Cluster, fsname string, group string, target string) error {
+	out, err := cluster.Ceph(ctx, runner, groupArgs(group, "fs", "clone", "cancel", fsname, target)...)
+	if(err != nil) {
+		return errors.New(UNABLE_CLONE_VOLUME+err.Error())
+	}
+	logrus.Debug(out)
+	return nil
+}
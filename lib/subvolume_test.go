@@ -0,0 +1,78 @@
+package lib
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseSubvolumeInfo(t *testing.T) {
+	sub, err := parseSubvolumeInfo(readSample(t, "subvolume_info.json"))
+
+	assert.Nil(t, err)
+	assert.Equal(t, &Subvolume{
+		Path:     "/volumes/docker/web/4f8fbd38-7b2c-4b2e-9d3b-2d6d7b9c1a11",
+		DataPool: "cephfs_data",
+		Quota:    Quota{MaxBytes: 10737418240, Bytes: 52428800},
+	}, sub)
+
+	sub, err = parseSubvolumeInfo(readSample(t, "subvolume_info_infinite.json"))
+
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(0), sub.Quota.MaxBytes)
+
+	_, err = parseSubvolumeInfo([]byte("Error ENOENT"))
+	assert.NotNil(t, err)
+}
+
+func TestParseNames(t *testing.T) {
+	names, err := parseNames(readSample(t, "subvolume_ls.json"))
+
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"web", "db"}, names)
+}
+
+func TestParseSnapshotCreated(t *testing.T) {
+	created, err := parseSnapshotCreated(readSample(t, "subvolume_snapshot_info.json"))
+
+	assert.Nil(t, err)
+	assert.Equal(t, time.Date(2024, 3, 11, 12, 30, 0, 123456000, time.UTC), created)
+}
+
+func TestParseCloneStatus(t *testing.T) {
+	clone, err := parseCloneStatus(readSample(t, "clone_status.json"))
+
+	assert.Nil(t, err)
+	assert.Equal(t, Clone{State: CloneCopying, Progress: "12.24%"}, clone)
+
+	clone, err = parseCloneStatus(readSample(t, "clone_status_failed.json"))
+
+	assert.Nil(t, err)
+	assert.Equal(t, Clone{State: CloneFailed, Error: "failed: Disk quota exceeded"}, clone)
+}
+
+func TestSubvolumeCommands(t *testing.T) {
+	ctx := context.Background()
+	cluster := Cluster{Name: "default", Monitors: []string{"mon1"}, User: "admin"}
+	runner := NewFakeRunner()
+	runner.On("ceph fs subvolume info cephfs gone", "", &CommandError{Command: "ceph", ExitCode: 2})
+
+	assert.Nil(t, CreateSubvolume(ctx, runner, cluster, "cephfs", "docker", "web", 1024, "cephfs_ssd"))
+	assert.Nil(t, ResizeSubvolume(ctx, runner, cluster, "cephfs", "docker", "web", 0))
+	assert.Nil(t, CreateSubvolume(ctx, runner, cluster, "cephfs", "", "db", 0, ""))
+	assert.Nil(t, CloneSubvolumeSnapshot(ctx, runner, cluster, "cephfs", "docker", "web", "nightly", "staging"))
+	assert.NotNil(t, CreateSubvolumeSnapshot(ctx, runner, cluster, "cephfs", "docker", "web", "../escape"))
+	sub, err := GetSubvolume(ctx, runner, cluster, "cephfs", "docker", "gone")
+	assert.Nil(t, err)
+	assert.Nil(t, sub)
+
+	assert.Equal(t, []string{
+		"ceph --mon-host mon1 --id admin fs subvolume create cephfs web --size 1024 --pool_layout cephfs_ssd --group_name docker",
+		"ceph --mon-host mon1 --id admin fs subvolume resize cephfs web infinite --group_name docker",
+		"ceph --mon-host mon1 --id admin fs subvolume create cephfs db",
+		"ceph --mon-host mon1 --id admin fs subvolume snapshot clone cephfs web nightly staging --group_name docker --target_group_name docker",
+		"ceph --mon-host mon1 --id admin fs subvolume info cephfs gone --format json --group_name docker",
+	}, runner.Calls())
+}
@@ -0,0 +1,88 @@
+package lib
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	XATTR_QUOTA_MAX_BYTES = "ceph.quota.max_bytes"
+	XATTR_QUOTA_MAX_FILES = "ceph.quota.max_files"
+	XATTR_DIR_RBYTES = "ceph.dir.rbytes"
+	XATTR_DIR_RFILES = "ceph.dir.rfiles"
+)
+
+// Quota holds the configured limits and the current usage of a directory,
+// a limit of 0 means unlimited.
+type Quota struct {
+	MaxBytes	uint64
+	MaxFiles	uint64
+	Bytes		uint64
+	Files		uint64
+}
+
+// ParseQuota validates a quota option value.
+func ParseQuota(value string) (uint64, error) {
+	quota, err := strconv.ParseUint(strings.TrimSpace(value), 10, 64)
+	if(err != nil) {
+		return 0, errors.New(INVALID_QUOTA+value)
+	}
+	return quota, nil
+}
+
+// SetQuota applies the limits to a directory on a mounted CephFS.
+func SetQuota(path string, maxBytes uint64, maxFiles uint64) error {
+	err := setXattrUint(path, XATTR_QUOTA_MAX_BYTES, maxBytes)
+	if(err != nil) {
+		return err
+	}
+	return setXattrUint(path, XATTR_QUOTA_MAX_FILES, maxFiles)
+}
+
+// GetQuota reads the limits and the recursive usage of a directory on a mounted CephFS.
+func GetQuota(path string) (Quota, error) {
+	var quota Quota
+	var err error
+
+	if quota.MaxBytes, err = getXattrUint(path, XATTR_QUOTA_MAX_BYTES); err != nil {
+		return quota, err
+	}
+	if quota.MaxFiles, err = getXattrUint(path, XATTR_QUOTA_MAX_FILES); err != nil {
+		return quota, err
+	}
+	if quota.Bytes, err = getXattrUint(path, XATTR_DIR_RBYTES); err != nil {
+		return quota, err
+	}
+	if quota.Files, err = getXattrUint(path, XATTR_DIR_RFILES); err != nil {
+		return quota, err
+	}
+
+	return quota, nil
+}
+
+func setXattrUint(path string, name string, value uint64) error {
+	err := syscall.Setxattr(path, name, []byte(strconv.FormatUint(value, 10)), 0)
+	if(err != nil) {
+		return errors.New(UNABLE_SET_QUOTA+name+": "+err.Error())
+	}
+	return nil
+}
+
+// getXattrUint returns 0 if the attribute isn't set.
+func getXattrUint(path string, name string) (uint64, error) {
+	buf := make([]byte, 64)
+	n, err := syscall.Getxattr(path, name, buf)
+	if(err == syscall.ENODATA) {
+		return 0, nil
+	} else if(err != nil) {
+		return 0, errors.New(UNABLE_GET_QUOTA+name+": "+err.Error())
+	}
+
+	value, err := strconv.ParseUint(strings.Trim(string(buf[:n]), " \n\x00"), 10, 64)
+	if(err != nil) {
+		return 0, errors.New(UNABLE_GET_QUOTA+name+": "+err.Error())
+	}
+	return value, nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	lib "./lib"
+
+	"github.com/Sirupsen/logrus"
+	"context"
+	"path/filepath"
+	"strings"
+)
+
+var mountInfoFile = "/proc/self/mountinfo"
+
+// reconcileMounts matches the ceph mounts below the plugin root and on the
+// mountpoints of known volumes, which may lie elsewhere with the path
+// option, to the volumes after a restart of the plugin or dockerd. Live
+// mounts of volumes and management mounts are adopted, mounts which don't
+// respond, belong to no volume or are left over from temporary root mounts
+// are lazily unmounted. A mountpoint with stacked mounts keeps only one of
+// them.
+func (d *cephFSDriver) reconcileMounts(ctx context.Context) {
+	mounts, err := d.inspector.Mounts()
+	if(err != nil) {
+		logrus.Error(err.Error())
+		return
+	}
+
+	paths := make(map[string]string)
+	for _, vol := range d.volumeList() {
+		paths[filepath.Clean(vol.Filesystem.Path)] = vol.Name
+	}
+
+	var mountpoints []string
+	stacked := make(map[string]int)
+	for _, mount := range mounts {
+		_, known := paths[mount.Mountpoint]
+		if(!mount.IsCeph() || (!known && !d.belowRoot(mount.Mountpoint))) {
+			continue
+		}
+		if(stacked[mount.Mountpoint] == 0) {
+			mountpoints = append(mountpoints, mount.Mountpoint)
+		}
+		stacked[mount.Mountpoint]++
+	}
+
+	adopted, unmounted := 0, 0
+	for _, mountpoint := range mountpoints {
+		count := stacked[mountpoint]
+		if(d.adoptMount(mountpoint, paths[mountpoint])) {
+			adopted++
+			count--
+		}
+		for ; count > 0; count-- {
+			logrus.Warn("Unmounting ", mountpoint, " left behind by a previous run ...")
+			_, err := d.runner.Run(ctx, "umount", "-l", mountpoint)
+			if(err != nil) {
+				logrus.Error(lib.UNABLE_UNMOUNT+err.Error())
+				break
+			}
+			unmounted++
+		}
+	}
+
+	logrus.Info("Reconciled ", len(mountpoints), " mount(s) of a previous run, ", adopted, " adopted, ", unmounted, " unmounted")
+}
+
+// belowRoot reports whether a path lies below the plugin root.
+func (d *cephFSDriver) belowRoot(file string) bool {
+	rel, err := filepath.Rel(d.defaultPath, file)
+	return err == nil && rel != "." && !strings.HasPrefix(rel, "..")
+}
+
+// adoptMount takes over a live mount of the volume name, given if a known
+// volume is mounted there, or of a filesystem root and reports whether it
+// should be kept. Mount IDs of volumes whose mount is dropped are forgotten.
+func (d *cephFSDriver) adoptMount(mountpoint string, name string) bool {
+	rel, _ := filepath.Rel(d.defaultPath, mountpoint)
+	parts := strings.Split(rel, "/")
+	live := d.inspector.Check(mountpoint) == nil
+
+	switch {
+	case len(name) > 0:
+		d.lock.Lock()
+		defer d.lock.Unlock()
+
+		if(!live) {
+			delete(d.mounts, name)
+			return false
+		}
+		if(len(d.mounts[name]) == 0) {
+			// The next container uses the mount instead of stacking another one
+			d.adopted[name] = true
+		}
+		return true
+	case len(parts) == 3 && parts[0] == managementDir:
+		if(!live) {
+			return false
+		}
+		d.manage.Lock()
+		d.manage.mounted[mountpoint] = true
+		d.manage.Unlock()
+		return true
+	}
+	return false
+}
+
+// takeAdopted reports whether the volume is still mounted from a previous
+// run, the mount is counted by mount IDs afterwards.
+func (d *cephFSDriver) takeAdopted(name string) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	adopted := d.adopted[name]
+	delete(d.adopted, name)
+	return adopted
+}
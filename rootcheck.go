@@ -0,0 +1,98 @@
+package main
+
+import (
+	lib "./lib"
+
+	"github.com/Sirupsen/logrus"
+	"context"
+	"errors"
+	"os"
+	"path"
+)
+
+// Policies for a plugin root which isn't on ceph.
+const (
+	rootCheckWarn	= "warn"
+	rootCheckRefuse	= "refuse"
+	rootCheckMount	= "mount"
+)
+
+// pluginDir is the directory of the default filesystem which root_check
+// mount mounts on the plugin root. Volume names can't start with a dot, so
+// the state and mount trees of the plugin never show up as volumes.
+const pluginDir = ".docker-volume-cephfs"
+
+// checkRoot probes the filesystem of the plugin root at startup. A root on
+// a local disk is only reported, refused or replaced by a mount of the
+// default filesystem, depending on root_check.
+func checkRoot(ctx context.Context, runner lib.CommandRunner, inspector lib.MountInspector, config Config) error {
+	fstype, err := inspector.Probe(config.Path)
+	if(err != nil) {
+		err = errors.New(lib.UNABLE_PROBE_ROOT+err.Error())
+		if(config.RootCheck == rootCheckWarn) {
+			logrus.Warn(err.Error())
+			return nil
+		}
+		return err
+	}
+	if(fstype != lib.FileSystemLocal) {
+		logrus.Info("Plugin root ", config.Path, " is on ", fstype)
+		return nil
+	}
+
+	switch config.RootCheck {
+	case rootCheckRefuse:
+		return errors.New(lib.ROOT_NOT_CEPH+config.Path)
+	case rootCheckMount:
+		return mountRoot(ctx, runner, inspector, config)
+	}
+	logrus.Warn(lib.ROOT_NOT_CEPH+config.Path)
+	return nil
+}
+
+// mountRoot creates the plugin root and mounts the plugin directory of the
+// default filesystem on it, the directory is created through the root of
+// the filesystem first.
+func mountRoot(ctx context.Context, runner lib.CommandRunner, inspector lib.MountInspector, config Config) error {
+	err := os.MkdirAll(config.Path, os.ModePerm)
+	if(err != nil) {
+		return errors.New(lib.UNABLE_CREATE_DIR+err.Error())
+	}
+
+	cluster := config.ClusterRegistry()[config.DefaultClusterName()]
+	fsvol := lib.Volume{
+		Name: "root",
+		Subpath: "/",
+		Filesystem: lib.Filesystem{Name: cluster.Filesystem, Path: config.Path},
+		MountType: config.MountType,
+	}
+	logrus.Info("Creating ", pluginDir, " in the default filesystem ...")
+	err = fsvol.Mount(ctx, runner, cluster)
+	if(err != nil) {
+		return err
+	}
+	err = os.MkdirAll(path.Join(config.Path, pluginDir), os.ModePerm)
+	uerr := fsvol.Unmount(ctx, runner)
+	if(err != nil) {
+		return errors.New(lib.UNABLE_CREATE_DIR+err.Error())
+	}
+	if(uerr != nil) {
+		return uerr
+	}
+
+	logrus.Info("Mounting ", pluginDir, " of the default filesystem on the plugin root ", config.Path, " ...")
+	fsvol.Subpath = "/"+pluginDir
+	err = fsvol.Mount(ctx, runner, cluster)
+	if(err != nil) {
+		return err
+	}
+
+	fstype, err := inspector.Probe(config.Path)
+	if(err != nil) {
+		return errors.New(lib.UNABLE_PROBE_ROOT+err.Error())
+	}
+	if(fstype == lib.FileSystemLocal) {
+		return errors.New(lib.ROOT_NOT_CEPH+config.Path)
+	}
+	return nil
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	lib "./lib"
+
+	"github.com/Sirupsen/logrus"
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"time"
+)
+
+const snapshotInterval = time.Hour
+
+// withVolumeDir runs fn with the directory of the volume. A volume mounted
+// by a container is used directly, otherwise the volume is reached through
+// the management mount of its filesystem, which stays mounted between calls.
+func (d *cephFSDriver) withVolumeDir(ctx context.Context, vol lib.Volume, fn func(dir string) error) error {
+	if(d.mountCount(vol.Name) > 0) {
+		return fn(vol.Filesystem.Path)
+	}
+
+	cluster, err := d.cluster(vol)
+	if(err != nil) {
+		return err
+	}
+	root, err := d.managementMount(ctx, cluster, vol.Filesystem)
+	if(err != nil) {
+		return err
+	}
+	return fn(path.Join(root, vol.Subpath))
+}
+
+func (d *cephFSDriver) CreateSnapshot(name string, snapshot string) error {
+	unlock := d.locks.Lock(name)
+	defer unlock()
+	ctx, cancel := d.newContext()
+	defer cancel()
+
+	vol := d.volume(name)
+	if(vol == nil) {
+		return errors.New(lib.UNABLE_FIND_VOLUME+name)
+	}
+
+	if(len(vol.SubvolumeGroup) > 0) {
+		cluster, err := d.cluster(*vol)
+		if(err != nil) {
+			return err
+		}
+		return lib.CreateSubvolumeSnapshot(ctx, d.runner, cluster, vol.Filesystem.Name, vol.SubvolumeGroup, vol.Name, snapshot)
+	}
+
+	return d.withVolumeDir(ctx, *vol, func(dir string) error {
+		return lib.CreateSnapshot(dir, "/", snapshot)
+	})
+}
+
+func (d *cephFSDriver) DeleteSnapshot(name string, snapshot string) error {
+	unlock := d.locks.Lock(name)
+	defer unlock()
+	ctx, cancel := d.newContext()
+	defer cancel()
+
+	vol := d.volume(name)
+	if(vol == nil) {
+		return errors.New(lib.UNABLE_FIND_VOLUME+name)
+	}
+
+	if(len(vol.SubvolumeGroup) > 0) {
+		cluster, err := d.cluster(*vol)
+		if(err != nil) {
+			return err
+		}
+		return lib.RemoveSubvolumeSnapshot(ctx, d.runner, cluster, vol.Filesystem.Name, vol.SubvolumeGroup, vol.Name, snapshot)
+	}
+
+	return d.withVolumeDir(ctx, *vol, func(dir string) error {
+		return lib.DeleteSnapshot(dir, "/", snapshot)
+	})
+}
+
+func (d *cephFSDriver) ListSnapshots(name string) ([]lib.Snapshot, error) {
+	unlock := d.locks.Lock(name)
+	defer unlock()
+	ctx, cancel := d.newContext()
+	defer cancel()
+
+	vol := d.volume(name)
+	if(vol == nil) {
+		return nil, errors.New(lib.UNABLE_FIND_VOLUME+name)
+	}
+
+	if(len(vol.SubvolumeGroup) > 0) {
+		cluster, err := d.cluster(*vol)
+		if(err != nil) {
+			return nil, err
+		}
+		return lib.ListSubvolumeSnapshots(ctx, d.runner, cluster, vol.Filesystem.Name, vol.SubvolumeGroup, vol.Name)
+	}
+
+	var snaps []lib.Snapshot
+	err := d.withVolumeDir(ctx, *vol, func(dir string) error {
+		var err error
+		snaps, err = lib.ListSnapshots(dir, "/")
+		return err
+	})
+	return snaps, err
+}
+
+// PruneSnapshots deletes the scheduled snapshots of a volume which are
+// outside of its retention and returns their names.
+func (d *cephFSDriver) PruneSnapshots(name string) ([]string, error) {
+	unlock := d.locks.Lock(name)
+	defer unlock()
+	ctx, cancel := d.newContext()
+	defer cancel()
+
+	vol := d.volume(name)
+	if(vol == nil) {
+		return nil, errors.New(lib.UNABLE_FIND_VOLUME+name)
+	}
+	hourly, daily := snapshotRetention(*vol)
+
+	var pruned []string
+	prune := func(snaps []lib.Snapshot, remove func(name string) error) error {
+		for _, snap := range lib.ExpiredSnapshots(snaps, hourly, daily) {
+			err := remove(snap.Name)
+			if(err != nil) {
+				return err
+			}
+			pruned = append(pruned, snap.Name)
+		}
+		return nil
+	}
+
+	if(len(vol.SubvolumeGroup) > 0) {
+		cluster, err := d.cluster(*vol)
+		if(err != nil) {
+			return nil, err
+		}
+		snaps, err := lib.ListSubvolumeSnapshots(ctx, d.runner, cluster, vol.Filesystem.Name, vol.SubvolumeGroup, vol.Name)
+		if(err != nil) {
+			return nil, err
+		}
+		err = prune(snaps, func(name string) error {
+			return lib.RemoveSubvolumeSnapshot(ctx, d.runner, cluster, vol.Filesystem.Name, vol.SubvolumeGroup, vol.Name, name)
+		})
+		return pruned, err
+	}
+
+	err := d.withVolumeDir(ctx, *vol, func(dir string) error {
+		snaps, err := lib.ListSnapshots(dir, "/")
+		if(err != nil) {
+			return err
+		}
+		return prune(snaps, func(name string) error {
+			return lib.DeleteSnapshot(dir, "/", name)
+		})
+	})
+	return pruned, err
+}
+
+// RunSnapshotSchedule takes a snapshot of every volume with a snapshot
+// retention each interval and prunes the expired ones, until stop is closed.
+func (d *cephFSDriver) RunSnapshotSchedule(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			d.takeScheduledSnapshots(now)
+		}
+	}
+}
+
+func (d *cephFSDriver) takeScheduledSnapshots(now time.Time) {
+	for _, vol := range d.volumeList() {
+		hourly, daily := snapshotRetention(vol)
+		if(hourly == 0 && daily == 0) {
+			continue
+		}
+
+		logrus.Info("Taking scheduled snapshot of ", vol.Name, " ...")
+		err := d.CreateSnapshot(vol.Name, lib.ScheduledSnapshotName(now))
+		if(err != nil) {
+			logrus.Error(err.Error())
+			continue
+		}
+		pruned, err := d.PruneSnapshots(vol.Name)
+		if(err != nil) {
+			logrus.Error(err.Error())
+		}
+		logrus.Info("Pruned ", len(pruned), " snapshot(s) of ", vol.Name)
+	}
+}
+
+// snapshotRetention returns the number of hourly and daily snapshots to keep.
+func snapshotRetention(vol lib.Volume) (int, int) {
+	hourly, _ := strconv.Atoi(vol.Options["snapshot_keep_hourly"])
+	daily, _ := strconv.Atoi(vol.Options["snapshot_keep_daily"])
+	return hourly, daily
+}
+
+func validSnapshotRetention(val string) error {
+	keep, err := strconv.Atoi(val)
+	if(err != nil || keep < 0) {
+		return errors.New(lib.INVALID_SNAPSHOT_RETENTION+val)
+	}
+	return nil
+}
+
+// snapshotStatus lists the snapshots of a volume for its status.
+func snapshotStatus(snaps []lib.Snapshot) []map[string]interface{} {
+	status := []map[string]interface{}{}
+	for _, snap := range snaps {
+		status = append(status, map[string]interface{}{
+			"name":    snap.Name,
+			"created": snap.Created.UTC().Format(time.RFC3339),
+		})
+	}
+	return status
+}
+
+// snapshotCommand implements
+//
+//	docker-volume-cephfs [flags] snapshot create|rm <volume> <snapshot>
+//	docker-volume-cephfs [flags] snapshot ls|prune <volume>
+func snapshotCommand(config Config, args []string) error {
+	usage := errors.New("usage: snapshot create|rm <volume> <snapshot> | snapshot ls|prune <volume>")
+	if(len(args) < 2) {
+		return usage
+	}
+
+	d, err := loadCephFSDriver(lib.NewShellRunner(), config)
+	if(err != nil) {
+		return err
+	}
+
+	switch args[0] {
+	case "create", "rm":
+		if(len(args) != 3) {
+			return usage
+		}
+		if(args[0] == "create") {
+			return d.CreateSnapshot(args[1], args[2])
+		}
+		return d.DeleteSnapshot(args[1], args[2])
+	case "ls":
+		snaps, err := d.ListSnapshots(args[1])
+		if(err != nil) {
+			return err
+		}
+		for _, snap := range snaps {
+			fmt.Printf("%s\t%s\n", snap.Created.UTC().Format(time.RFC3339), snap.Name)
+		}
+		return nil
+	case "prune":
+		pruned, err := d.PruneSnapshots(args[1])
+		for _, name := range pruned {
+			fmt.Println(name)
+		}
+		return err
+	}
+	return usage
+}
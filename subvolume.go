@@ -0,0 +1,222 @@
+package main
+
+import (
+	lib "./lib"
+
+	"github.com/Sirupsen/logrus"
+	"context"
+	"errors"
+	"path"
+	"time"
+)
+
+var cloneStatusInterval = 5 * time.Second
+
+// createSubvolume creates the subvolume of a new volume, or resizes it if it
+// already exists, and sets the subpath of the volume to its path. It
+// reports whether the subvolume was created.
+func (d *cephFSDriver) createSubvolume(ctx context.Context, cluster lib.Cluster, vol *lib.Volume, src *lib.Volume) (bool, error) {
+	fsname := vol.Filesystem.Name
+
+	logrus.Info("Creating subvolume group ...")
+	err := lib.CreateSubvolumeGroup(ctx, d.runner, cluster, fsname, vol.SubvolumeGroup)
+	if(err != nil) {
+		return false, err
+	}
+
+	// A server side clone creates the subvolume, its path is known once it is complete
+	if(src != nil && subvolumeClone(*vol, *src)) {
+		vol.Subpath = ""
+		return false, nil
+	}
+
+	logrus.Info("Checking subvolume ...")
+	sub, err := lib.GetSubvolume(ctx, d.runner, cluster, fsname, vol.SubvolumeGroup, vol.Name)
+	if(err != nil) {
+		return false, err
+	}
+	created := sub == nil
+	if(sub == nil) {
+		logrus.Info("Creating new subvolume ...")
+		err = lib.CreateSubvolume(ctx, d.runner, cluster, fsname, vol.SubvolumeGroup, vol.Name, vol.Quota.MaxBytes, vol.Filesystem.DataPool)
+	} else if _, ok := vol.Options["quota_bytes"]; ok && sub.Quota.MaxBytes != vol.Quota.MaxBytes {
+		logrus.Info("Resizing subvolume ...")
+		err = lib.ResizeSubvolume(ctx, d.runner, cluster, fsname, vol.SubvolumeGroup, vol.Name, vol.Quota.MaxBytes)
+	}
+	if(err != nil) {
+		return false, err
+	}
+
+	sub, err = lib.GetSubvolume(ctx, d.runner, cluster, fsname, vol.SubvolumeGroup, vol.Name)
+	if(err != nil) {
+		return created, err
+	} else if(sub == nil) {
+		return false, errors.New(lib.UNABLE_CREATE_SUBVOLUME+"missing after creation: "+vol.Name)
+	}
+	vol.Subpath = sub.Path
+
+	// Subvolumes only limit bytes, the file limit is set on the directory
+	if(vol.Quota.MaxFiles > 0) {
+		logrus.Info("Setting quota ...")
+		err = d.withRootMount(ctx, *vol, func(root string) error {
+			return lib.SetQuota(path.Join(root, vol.Subpath), vol.Quota.MaxBytes, vol.Quota.MaxFiles)
+		})
+	}
+	return created, err
+}
+
+// subvolumePath fills in the path of a subvolume which was created by a
+// server side clone and saves it. It is resolved on the first mount, read
+// only requests like Get don't change the volume.
+func (d *cephFSDriver) subvolumePath(ctx context.Context, vol lib.Volume) (lib.Volume, error) {
+	if(len(vol.SubvolumeGroup) == 0 || len(vol.Subpath) > 0) {
+		return vol, nil
+	}
+	if(!d.cloneComplete(vol.Name)) {
+		return vol, errors.New(lib.CLONE_NOT_COMPLETE+vol.Name)
+	}
+
+	cluster, err := d.cluster(vol)
+	if(err != nil) {
+		return vol, err
+	}
+	sub, err := lib.GetSubvolume(ctx, d.runner, cluster, vol.Filesystem.Name, vol.SubvolumeGroup, vol.Name)
+	if(err != nil) {
+		return vol, err
+	} else if(sub == nil) {
+		return vol, errors.New(lib.UNABLE_FIND_VOLUME+vol.Name)
+	}
+	vol.Subpath = sub.Path
+
+	// The client of the volume can only be restricted to a known path
+	if(authorized(vol)) {
+		err = d.authorizeClient(ctx, cluster, &vol)
+		if(err != nil) {
+			return vol, err
+		}
+	}
+
+	d.replaceVolume(vol)
+	d.saveState()
+	return vol, nil
+}
+
+// removeSubvolume deletes the snapshots of a subvolume and moves it to the trash.
+func (d *cephFSDriver) removeSubvolume(ctx context.Context, vol lib.Volume) error {
+	cluster, err := d.cluster(vol)
+	if(err != nil) {
+		return err
+	}
+	fsname := vol.Filesystem.Name
+
+	// A subvolume with snapshots can't be removed
+	if(len(vol.Subpath) > 0) {
+		logrus.Info("Deleting snapshots ...")
+		snaps, err := lib.ListSubvolumeSnapshots(ctx, d.runner, cluster, fsname, vol.SubvolumeGroup, vol.Name)
+		if(err != nil) {
+			return err
+		}
+		for _, snap := range snaps {
+			err = lib.RemoveSubvolumeSnapshot(ctx, d.runner, cluster, fsname, vol.SubvolumeGroup, vol.Name, snap.Name)
+			if(err != nil) {
+				return err
+			}
+		}
+	}
+
+	logrus.Info("Removing subvolume ...")
+	err = lib.RemoveSubvolume(ctx, d.runner, cluster, fsname, vol.SubvolumeGroup, vol.Name)
+	if(err != nil) {
+		return err
+	}
+
+	// The client is only revoked once the volume is gone
+	return d.revokeClient(ctx, vol)
+}
+
+// subvolumeClone reports whether ceph can clone the source into the volume,
+// which needs both to be subvolumes of the same group and filesystem.
+func subvolumeClone(vol lib.Volume, src lib.Volume) bool {
+	return len(vol.SubvolumeGroup) > 0 &&
+		src.SubvolumeGroup == vol.SubvolumeGroup &&
+		src.Cluster == vol.Cluster &&
+		src.Filesystem.Name == vol.Filesystem.Name
+}
+
+// runSubvolumeClone clones a snapshot of the source subvolume into the
+// volume and waits for ceph to complete it. A clone of the volume itself
+// goes through a temporary snapshot.
+func (d *cephFSDriver) runSubvolumeClone(ctx context.Context, vol lib.Volume, src lib.Volume, snapshot string) error {
+	cluster, err := d.cluster(src)
+	if(err != nil) {
+		return err
+	}
+	fsname := src.Filesystem.Name
+
+	if(len(snapshot) == 0) {
+		snapshot = "clone-"+vol.Name
+		err = lib.CreateSubvolumeSnapshot(ctx, d.runner, cluster, fsname, src.SubvolumeGroup, src.Name, snapshot)
+		if(err != nil) {
+			return err
+		}
+		defer func() {
+			rctx, cancel := d.newContext()
+			defer cancel()
+			err := lib.RemoveSubvolumeSnapshot(rctx, d.runner, cluster, fsname, src.SubvolumeGroup, src.Name, snapshot)
+			if(err != nil) {
+				logrus.Warn(err.Error())
+			}
+		}()
+	}
+
+	err = lib.CloneSubvolumeSnapshot(ctx, d.runner, cluster, fsname, src.SubvolumeGroup, src.Name, snapshot, vol.Name)
+	if(err != nil) {
+		return err
+	}
+	return d.waitSubvolumeClone(ctx, vol)
+}
+
+// subvolumeCloneStatus asks ceph for the state of the server side clone into a volume.
+func (d *cephFSDriver) subvolumeCloneStatus(vol lib.Volume) (lib.Clone, error) {
+	cluster, err := d.cluster(vol)
+	if(err != nil) {
+		return lib.Clone{}, err
+	}
+	ctx, cancel := d.newContext()
+	defer cancel()
+	return lib.SubvolumeCloneStatus(ctx, d.runner, cluster, vol.Filesystem.Name, vol.SubvolumeGroup, vol.Name)
+}
+
+// waitSubvolumeClone follows a server side clone into the volume until ceph
+// completes it.
+func (d *cephFSDriver) waitSubvolumeClone(ctx context.Context, vol lib.Volume) error {
+	cluster, err := d.cluster(vol)
+	if(err != nil) {
+		return err
+	}
+	fsname := vol.Filesystem.Name
+
+	for {
+		status, err := lib.SubvolumeCloneStatus(ctx, d.runner, cluster, fsname, vol.SubvolumeGroup, vol.Name)
+		if(err != nil) {
+			return err
+		}
+		d.clones.report(vol.Name, status.Progress)
+		switch status.State {
+		case lib.CloneComplete:
+			return nil
+		case lib.CloneFailed:
+			return errors.New(lib.UNABLE_CLONE_VOLUME+status.Error)
+		}
+
+		select {
+		case <-ctx.Done():
+			// The volume is removed, stop ceph as well
+			cctx, cancel := d.newContext()
+			defer cancel()
+			lib.CancelSubvolumeClone(cctx, d.runner, cluster, fsname, vol.SubvolumeGroup, vol.Name)
+			return ctx.Err()
+		case <-time.After(cloneStatusInterval):
+		}
+	}
+}